@@ -11,6 +11,16 @@ type ICache[K comparable, V any] interface {
 	Get(key K) (V, bool)
 	Remove(key K)
 	Pop(key K) (V, bool)
+	// Len returns the number of items, including the expired ones not cleaned up yet
+	Len() int
+	// Range calls f for every unexpired item until f returns false, the cache must not be modified by f
+	Range(f func(key K, value V) bool)
+	// Clear removes all the items
+	Clear()
+	// OnExpire sets a handler called for every expired item the cleanup removes
+	OnExpire(f func(key K, value V))
+	// Close stops the cleanup of the expired items, waiting for a running cleanup, the cache remains usable
+	Close()
 }
 
 // TTLCache is a generic in-memory key-value cache with optional TTL support.
@@ -18,6 +28,10 @@ type TTLCache[K comparable, V any] struct {
 	items         map[K]*item[V]
 	mu            sync.RWMutex
 	cleanInterval *time.Duration
+	onExpire      func(key K, value V)
+	stop          chan struct{}
+	done          chan struct{} // closed once the cleanup stopped
+	closeOnce     sync.Once
 }
 
 type item[V any] struct {
@@ -33,9 +47,11 @@ var (
 func New[K comparable, V any](cleanInterval ...time.Duration) ICache[K, V] {
 	c := &TTLCache[K, V]{
 		items: make(map[K]*item[V]),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
 	}
 
-	if len(cleanInterval) > 0 {
+	if len(cleanInterval) > 0 && cleanInterval[0] > 0 {
 		c.cleanInterval = &cleanInterval[0]
 	} else {
 		c.cleanInterval = &defaultCleanInterval
@@ -94,18 +110,80 @@ func (c *TTLCache[K, V]) Pop(key K) (V, bool) {
 	return zeroV, false
 }
 
+// Len returns the number of items, including the expired ones not cleaned up yet.
+func (c *TTLCache[K, V]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.items)
+}
+
+// Range calls f for every unexpired item until f returns false, the cache must not be modified by f.
+func (c *TTLCache[K, V]) Range(f func(key K, value V) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	for key, item := range c.items {
+		if item.expiry != nil && item.expiry.Before(now) {
+			continue
+		}
+		if !f(key, item.value) {
+			return
+		}
+	}
+}
+
+// Clear removes all the items.
+func (c *TTLCache[K, V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[K]*item[V])
+}
+
+// OnExpire sets a handler called for every expired item the cleanup removes, outside the lock of the cache.
+func (c *TTLCache[K, V]) OnExpire(f func(key K, value V)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onExpire = f
+}
+
+// Close stops the cleanup of the expired items and waits for a running cleanup to finish, the cache remains usable.
+func (c *TTLCache[K, V]) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
 // cleanupExpiredItems periodically removes expired items.
 func (c *TTLCache[K, V]) cleanupExpiredItems() {
+	defer close(c.done)
 	ticker := time.NewTicker(*c.cleanInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		var expired []K
+		var values []V
 		c.mu.Lock()
+		onExpire := c.onExpire
 		for key, item := range c.items {
 			if item.expiry != nil && item.expiry.Before(time.Now()) {
 				delete(c.items, key)
+				if onExpire != nil {
+					expired = append(expired, key)
+					values = append(values, item.value)
+				}
 			}
 		}
 		c.mu.Unlock()
+		for i, key := range expired {
+			onExpire(key, values[i])
+		}
 	}
 }
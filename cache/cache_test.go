@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// caches are the ICache implementations under test, by name
+var caches = map[string]func(cleanInterval time.Duration) ICache[string, int]{
+	"ttl": func(cleanInterval time.Duration) ICache[string, int] { return New[string, int](cleanInterval) },
+	"sharded": func(cleanInterval time.Duration) ICache[string, int] {
+		return NewSharded[string, int](4, cleanInterval)
+	},
+}
+
+func TestRangeClearOnExpire(t *testing.T) {
+	for name, newCache := range caches {
+		t.Run(name, func(t *testing.T) { testRangeClearOnExpire(t, newCache(10*time.Millisecond)) })
+	}
+}
+
+func testRangeClearOnExpire(t *testing.T, c ICache[string, int]) {
+	defer c.Close()
+	var expired sync.Map
+	c.OnExpire(func(key string, value int) { expired.Store(key, value) })
+	c.Set("a", 1)
+	c.Set("b", 2, time.Hour)
+	c.Set("old", 3, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	seen := make(map[string]int)
+	c.Range(func(key string, value int) bool {
+		seen[key] = value
+		return true
+	})
+	if len(seen) != 2 || seen["a"] != 1 || seen["b"] != 2 {
+		t.Fatalf("ranged over %v, want the unexpired items", seen)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if value, ok := expired.Load("old"); ok {
+			if value != 3 {
+				t.Fatalf("expired value %v", value)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired item not reported")
+		}
+	}
+	if c.Len() != 2 {
+		t.Fatalf("len = %d after the cleanup, want 2", c.Len())
+	}
+	c.Clear()
+	if c.Len() != 0 {
+		t.Fatalf("len = %d after clear", c.Len())
+	}
+
+	// Once Close returns no cleanup runs anymore
+	c.Close()
+	c.Set("after close", 1, time.Nanosecond)
+	time.Sleep(30 * time.Millisecond)
+	if c.Len() != 1 {
+		t.Fatalf("len = %d, cleaned up after close", c.Len())
+	}
+}
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShardedCache is a generic in-memory key-value cache with optional TTL support, split into shards by key hash so
+// readers & writers of different keys don't contend for one lock. Each shard keeps its expiring items in a heap, so the
+// cleanup only visits the expired items, in batches under the shard's lock.
+type ShardedCache[K comparable, V any] struct {
+	shards        []*shard[K, V]
+	mask          uint64
+	seed          maphash.Seed
+	cleanInterval time.Duration
+	onExpire      atomic.Pointer[func(key K, value V)]
+	stop          chan struct{}
+	done          chan struct{} // closed once the cleanup stopped
+	closeOnce     sync.Once
+}
+
+type shard[K comparable, V any] struct {
+	mu     sync.RWMutex
+	items  map[K]shardItem[V]
+	expiry expiryHeap[K]
+}
+
+type shardItem[V any] struct {
+	value  V
+	expiry int64 // unix nanoseconds, 0: never expires
+}
+
+// expiryHeap is the expiry of the items by time, an entry is outdated once its item is set again or removed
+type expiryHeap[K comparable] []expiryEntry[K]
+
+type expiryEntry[K comparable] struct {
+	key    K
+	expiry int64
+}
+
+func (h expiryHeap[K]) Len() int           { return len(h) }
+func (h expiryHeap[K]) Less(i, j int) bool { return h[i].expiry < h[j].expiry }
+func (h expiryHeap[K]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap[K]) Push(x any)        { *h = append(*h, x.(expiryEntry[K])) }
+func (h *expiryHeap[K]) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// cleanupBatch is the most expired items a shard's cleanup removes before releasing the lock for readers & writers
+const cleanupBatch = 1024
+
+// NewSharded creates a new ShardedCache instance with the number of shards rounded up to a power of two, 0 for a
+// default by the number of CPUs
+func NewSharded[K comparable, V any](shards int, cleanInterval ...time.Duration) ICache[K, V] {
+	if shards <= 0 {
+		shards = 16 * runtime.GOMAXPROCS(0)
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	c := &ShardedCache[K, V]{
+		shards:        make([]*shard[K, V], n),
+		mask:          uint64(n - 1),
+		seed:          maphash.MakeSeed(),
+		cleanInterval: defaultCleanInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard[K, V]{items: make(map[K]shardItem[V])}
+	}
+	if len(cleanInterval) > 0 && cleanInterval[0] > 0 {
+		c.cleanInterval = cleanInterval[0]
+	}
+	go c.cleanupExpiredItems()
+
+	return c
+}
+
+func (c *ShardedCache[K, V]) shard(key K) *shard[K, V] {
+	var h uint64
+	if s, ok := any(key).(string); ok {
+		h = maphash.String(c.seed, s)
+	} else {
+		h = maphash.Comparable(c.seed, key)
+	}
+	return c.shards[h&c.mask]
+}
+
+// Set adds or updates a key-value pair in the cache with optional TTL, if no TTL is specified the item will not expire.
+func (c *ShardedCache[K, V]) Set(key K, value V, ttl ...time.Duration) {
+	var expiry int64
+	if len(ttl) > 0 {
+		expiry = time.Now().Add(ttl[0]).UnixNano()
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items[key] = shardItem[V]{value: value, expiry: expiry}
+	if expiry != 0 {
+		heap.Push(&s.expiry, expiryEntry[K]{key: key, expiry: expiry})
+		if len(s.expiry) > 2*len(s.items)+64 {
+			s.compact()
+		}
+	}
+}
+
+// compact rebuilds the expiry heap without the outdated entries of the items set again or removed
+func (s *shard[K, V]) compact() {
+	entries := s.expiry[:0]
+	for key, item := range s.items {
+		if item.expiry != 0 {
+			entries = append(entries, expiryEntry[K]{key: key, expiry: item.expiry})
+		}
+	}
+	clear(s.expiry[len(entries):])
+	s.expiry = entries
+	heap.Init(&s.expiry)
+}
+
+// Get retrieves the value associated with the given key.
+func (c *ShardedCache[K, V]) Get(key K) (V, bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	item, found := s.items[key]
+	s.mu.RUnlock()
+
+	if !found || (item.expiry != 0 && item.expiry < time.Now().UnixNano()) {
+		var zeroV V
+		return zeroV, false
+	}
+	return item.value, true
+}
+
+// Remove deletes the key-value pair with the specified key.
+func (c *ShardedCache[K, V]) Remove(key K) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+}
+
+// Pop removes and returns the value associated with the specified key.
+func (c *ShardedCache[K, V]) Pop(key K) (V, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, found := s.items[key]
+	if found {
+		delete(s.items, key)
+		return item.value, true
+	}
+
+	var zeroV V
+	return zeroV, false
+}
+
+// Len returns the number of items, including the expired ones not cleaned up yet.
+func (c *ShardedCache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += len(s.items)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Range calls f for every unexpired item until f returns false, the cache must not be modified by f. The shards are
+// locked one at a time, so it's no snapshot of the whole cache.
+func (c *ShardedCache[K, V]) Range(f func(key K, value V) bool) {
+	now := time.Now().UnixNano()
+	for _, s := range c.shards {
+		if !s.rangeItems(now, f) {
+			return
+		}
+	}
+}
+
+func (s *shard[K, V]) rangeItems(now int64, f func(key K, value V) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key, item := range s.items {
+		if item.expiry != 0 && item.expiry < now {
+			continue
+		}
+		if !f(key, item.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Clear removes all the items.
+func (c *ShardedCache[K, V]) Clear() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[K]shardItem[V])
+		s.expiry = nil
+		s.mu.Unlock()
+	}
+}
+
+// OnExpire sets a handler called for every expired item the cleanup removes, outside the lock of the shard.
+func (c *ShardedCache[K, V]) OnExpire(f func(key K, value V)) {
+	c.onExpire.Store(&f)
+}
+
+// Close stops the cleanup of the expired items and waits for a running cleanup to finish, the cache remains usable.
+func (c *ShardedCache[K, V]) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// cleanupExpiredItems periodically removes the expired items of every shard.
+func (c *ShardedCache[K, V]) cleanupExpiredItems() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.cleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		var onExpire func(key K, value V)
+		if f := c.onExpire.Load(); f != nil {
+			onExpire = *f
+		}
+		for _, s := range c.shards {
+			for s.cleanup(time.Now().UnixNano(), onExpire) {
+			}
+		}
+	}
+}
+
+// cleanup removes a batch of the shard's expired items, true if there may be more
+func (s *shard[K, V]) cleanup(now int64, onExpire func(key K, value V)) bool {
+	var expired []K
+	var values []V
+	s.mu.Lock()
+	for n := 0; n < cleanupBatch && len(s.expiry) > 0 && s.expiry[0].expiry < now; n++ {
+		entry := heap.Pop(&s.expiry).(expiryEntry[K])
+		item, found := s.items[entry.key]
+		// The item was set again or removed since
+		if !found || item.expiry != entry.expiry {
+			continue
+		}
+		delete(s.items, entry.key)
+		if onExpire != nil {
+			expired = append(expired, entry.key)
+			values = append(values, item.value)
+		}
+	}
+	more := len(s.expiry) > 0 && s.expiry[0].expiry < now
+	s.mu.Unlock()
+
+	for i, key := range expired {
+		onExpire(key, values[i])
+	}
+	return more
+}
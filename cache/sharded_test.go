@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedExpiry(t *testing.T) {
+	c := NewSharded[string, int](4, 10*time.Millisecond)
+	var expired atomic.Int64
+	c.OnExpire(func(string, int) { expired.Add(1) })
+	for i := range 3 * cleanupBatch {
+		c.Set(strconv.Itoa(i), i, time.Nanosecond)
+	}
+	// Set again without a TTL, the outdated heap entry must not remove it
+	c.Set("renewed", 1, time.Nanosecond)
+	c.Set("renewed", 2)
+
+	for deadline := time.Now().Add(time.Second); c.Len() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("len = %d, the expired items weren't cleaned up", c.Len())
+		}
+	}
+	if value, ok := c.Get("renewed"); !ok || value != 2 {
+		t.Fatalf("renewed = %d, %v", value, ok)
+	}
+	if expired.Load() != 3*cleanupBatch {
+		t.Fatalf("%d expired items reported, want %d", expired.Load(), 3*cleanupBatch)
+	}
+
+	// Setting a key again leaves an outdated heap entry, the heap is compacted before they pile up
+	for i := range 10 * cleanupBatch {
+		c.Set("renewed", i, time.Hour)
+	}
+	for _, s := range c.(*ShardedCache[string, int]).shards {
+		if len(s.expiry) > 2*len(s.items)+64 {
+			t.Fatalf("%d heap entries of %d items", len(s.expiry), len(s.items))
+		}
+	}
+
+	c.Close()
+	c.Close()
+	c.Set("after close", 1, time.Nanosecond)
+	time.Sleep(30 * time.Millisecond)
+	if c.Len() != 2 {
+		t.Fatalf("len = %d, cleaned up after close", c.Len())
+	}
+}
+
+// benchmarkEntries is the number of cached items the benchmarks read & write
+const benchmarkEntries = 1_000_000
+
+// BenchmarkCache measures parallel throughput at 1M entries, with 1 of every writeEvery operations a Set
+func BenchmarkCache(b *testing.B) {
+	keys := make([]string, benchmarkEntries)
+	for i := range keys {
+		keys[i] = "1:eth_getBlockByNumber:[\"0x" + strconv.FormatInt(int64(i), 16) + "\",false]"
+	}
+	for name, newCache := range caches {
+		for _, writeEvery := range []int{10, 2} {
+			b.Run(name+"/writes=1:"+strconv.Itoa(writeEvery), func(b *testing.B) {
+				c := newCache(time.Second)
+				defer c.Close()
+				for i, key := range keys {
+					c.Set(key, i, time.Hour)
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+					for i := 0; pb.Next(); i++ {
+						key := keys[r.IntN(len(keys))]
+						if i%writeEvery == 0 {
+							c.Set(key, i, time.Hour)
+						} else {
+							c.Get(key)
+						}
+					}
+				})
+			})
+		}
+	}
+}
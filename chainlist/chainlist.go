@@ -1,30 +1,29 @@
 package chainlist
 
 import (
-	"bytes"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/huahuayu/onerpc/flags"
-	"github.com/huahuayu/onerpc/rpc"
-	"io"
+	"github.com/huahuayu/onerpc/logger"
+	"maps"
 	"math/big"
-	"net/http"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // ChainList is the http get response from https://chainid.network/chains.json
 type ChainList []*ChainInfo
 
 type ChainInfo struct {
-	Name             string            `json:"name"`
-	Chain            string            `json:"chain"`
-	Icon             string            `json:"icon,omitempty"`
-	Tvl              float64           `json:"tvl,omitempty"`
-	LlamaChainHeader *LlamaChainHeader `json:"LlamaChainHeader,omitempty"`
-	LlamaChainDetail *LlamaChain       `json:"LlamaChainDetail,omitempty"`
-	RPC              []string          `json:"rpc"`
+	Name             string              `json:"name"`
+	Chain            string              `json:"chain"`
+	Icon             string              `json:"icon,omitempty"`
+	Tvl              float64             `json:"tvl,omitempty"`
+	LlamaChainHeader *LlamaChainHeader   `json:"LlamaChainHeader,omitempty"`
+	LlamaChainDetail *LlamaChain         `json:"LlamaChainDetail,omitempty"`
+	RPC              []string            `json:"rpc"`
+	RPCInfo          map[string]*RPCInfo `json:"rpcInfo,omitempty"` // privacy metadata by rpc url
+	WSRPC            []string            `json:"wsRpc,omitempty"`   // websocket rpcs, kept apart from the http rpcs in RPC
 	Features         []struct {
 		Name string `json:"name"`
 	} `json:"features,omitempty"`
@@ -60,6 +59,13 @@ type ChainInfo struct {
 	} `json:"parent,omitempty"`
 }
 
+// RPCInfo is the privacy metadata of an rpc url, as published by chainlist.org
+type RPCInfo struct {
+	Tracking        string `json:"tracking,omitempty"` // none, limited, yes or empty if unspecified
+	TrackingDetails string `json:"trackingDetails,omitempty"`
+	IsOpenSource    bool   `json:"isOpenSource,omitempty"`
+}
+
 // LlamaChainHeaders is the http get response from https://api.llama.fi/v2/chains
 type LlamaChainHeaders []*LlamaChainHeader
 
@@ -126,47 +132,85 @@ type LlamaChain struct {
 // 1. Get all chain info from https://chainid.network/chains.json
 // 2. Get all chain header info from https://api.llama.fi/v2/chains, and merge with the result from step 1, the key is chainID
 // 3. Get all chain detail info from https://chainlist.org, and merge with the result from step 2, the key is chainID
-// 4. I specially care about the rpc's url, so merge the LlamaChains.PageProps.Chain.RPC.URL with the ChainInfo.RPC, remove duplicated rpc url
-// 5. Sort the result by Tvl in descending order
-// GetAllChainInfo gets all EVM chain info
-func GetAllChainInfo() (ChainList, map[int64]*ChainInfo, map[int64]rpc.RPCs, error) {
-	// Step 1: Get all chain info from chainid.network
-	chainList, err := getChainList()
+// 4. Merge the chains of our own registry & static config if configured, see DefaultSources
+// 5. I specially care about the rpc's url, so the rpc urls of all sources are merged, remove duplicated rpc url
+// 6. Sort the result by Tvl in descending order
+func GetAllChainInfo() (ChainList, map[int64]*ChainInfo, error) {
+	chainList, _, err := GetRemoteChainList()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
+	chainList, chainMap := Prepare(chainList)
+	return chainList, chainMap, nil
+}
 
-	// Step 2: Get all chain header info from llama.fi and merge to chainList
-	llamaChainHeaders, err := getLlamaChainHeaders()
-	if err != nil {
-		return nil, nil, nil, err
-	}
+// GetRemoteChainList fetches the chain registry sources and merges them, operator rpcs are not included. The sources
+// missing from the chain list are returned too, see Registry.Fetch.
+func GetRemoteChainList() (ChainList, []string, error) {
+	defaultRegistryOnce.Do(func() {
+		defaultRegistry = NewRegistry(DefaultSources()...)
+	})
+	return defaultRegistry.Fetch()
+}
 
-	// Step 3: Get all chain info from chainlist.org and merge to chainList
-	llamaChainDetails, err := getDetailLlamaChainInfo()
-	if err != nil {
-		return nil, nil, nil, err
+var (
+	defaultRegistry     *Registry
+	defaultRegistryOnce sync.Once
+)
+
+// DefaultSources returns the public chain registry sources plus the ones configured by flags
+func DefaultSources() []ChainSource {
+	sources := []ChainSource{
+		&ChainIDNetworkSource{URL: ChainIDNetworkURL},
+		&LlamaChainsSource{URL: LlamaChainsURL},
+		&ChainlistOrgSource{URL: ChainlistOrgURL},
+	}
+	// Our own registry wins conflicts with the public sources, the static chains override everything
+	if *flags.RegistryFile != "" {
+		sources = append(sources, NewFileSource(*flags.RegistryFile, 40, MergeFill))
+	}
+	if *flags.RegistryURL != "" {
+		sources = append(sources, NewHTTPSource(*flags.RegistryURL, 50, MergeFill))
+	}
+	if len(flags.StaticChains) > 0 {
+		var chains ChainList
+		if err := json.Unmarshal(flags.StaticChains, &chains); err != nil {
+			logger.Logger.Error().Str("error", err.Error()).Msg("parse static chains")
+		} else {
+			sources = append(sources, NewStaticSource(chains, 100, MergeOverride))
+		}
 	}
+	return sources
+}
 
-	// Step 4: Merge llamaChainHeaders, llamaChainDetails and private rpcs to chainList
+// Prepare merges the private rpcs into the chain list, normalizes the rpc urls, sorts it by Tvl in descending order and
+// indexes it by chainID
+func Prepare(chainList ChainList) (ChainList, map[int64]*ChainInfo) {
+	// Work on copies, the chain list is kept as loaded to prepare it again once the additional rpcs change
+	additionalRPCs := flags.GetPolicies().AdditionalRPCs
+	prepared := make(ChainList, 0, len(chainList))
 	for _, chain := range chainList {
-		if chainHeader, ok := llamaChainHeaders[chain.ChainID]; ok {
-			chain.Tvl = chainHeader.Tvl
-			chain.LlamaChainHeader = chainHeader
-		}
-		if chainDetail, ok := llamaChainDetails[chain.ChainID]; ok {
-			chain.LlamaChainDetail = chainDetail
-			mergeRpcInfo(chain, chainDetail, flags.AdditionalRPCs[chain.ChainID])
-		}
+		copied := *chain
+		copied.RPC = append([]string(nil), chain.RPC...)
+		copied.RPCInfo = maps.Clone(chain.RPCInfo)
+		mergeRpcURLs(&copied, additionalRPCs[chain.ChainID])
+		prepared = append(prepared, &copied)
 	}
+	chainList = prepared
+
+	// Keep websocket urls apart, fill or drop the urls with placeholders and skip deprecated & red flagged chains
+	chainList, summary := normalize(chainList, flags.RPCSecrets)
+	logSummary(summary)
 
 	// Exclude 1rpc.dev/* from the RPC list
 	for _, chain := range chainList {
-		for i, rpc := range chain.RPC {
-			if strings.Contains(rpc, "1rpc.dev") {
-				chain.RPC = append(chain.RPC[:i], chain.RPC[i+1:]...)
+		rpcs := make([]string, 0, len(chain.RPC))
+		for _, rpc := range chain.RPC {
+			if !strings.Contains(rpc, "1rpc.dev") {
+				rpcs = append(rpcs, rpc)
 			}
 		}
+		chain.RPC = rpcs
 	}
 
 	// Step 5: Sort the result by Tvl in descending order
@@ -185,133 +229,38 @@ func GetAllChainInfo() (ChainList, map[int64]*ChainInfo, map[int64]rpc.RPCs, err
 	for _, chain := range chainList {
 		chainMap[chain.ChainID] = chain
 	}
-
-	// Step 7: Group RPC by chainID
-	rpcMap := make(map[int64]rpc.RPCs)
-	for _, chain := range chainList {
-		urls := chain.RPC
-		rpcs := rpc.NewRPCs(chain.ChainID, urls)
-		rpcMap[chain.ChainID] = rpcs
-	}
-
-	return chainList, chainMap, rpcMap, nil
-}
-
-// getChainList fetches chain info from chainid.network
-func getChainList() (ChainList, error) {
-	resp, err := http.Get("https://chainid.network/chains.json")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to fetch chain list")
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var chainList ChainList
-	if err := json.Unmarshal(body, &chainList); err != nil {
-		return nil, err
-	}
-
-	return chainList, nil
+	return chainList, chainMap
 }
 
-// getLlamaChainHeaders fetches chain info from llama.fi and returns it as a map for easy lookup
-func getLlamaChainHeaders() (map[int64]*LlamaChainHeader, error) {
-	resp, err := http.Get("https://api.llama.fi/v2/chains")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to fetch llama chain headers")
+// mergeRpcInfo adds the privacy metadata of the urls without metadata yet to ChainInfo, or of all urls if overwrite is set
+func mergeRpcInfo(chainInfo *ChainInfo, rpcInfo map[string]*RPCInfo, overwrite bool) {
+	if len(rpcInfo) == 0 {
+		return
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var llamaChains LlamaChainHeaders
-	if err := json.Unmarshal(body, &llamaChains); err != nil {
-		return nil, err
+	merged := make(map[string]*RPCInfo, len(chainInfo.RPCInfo)+len(rpcInfo))
+	for url, info := range chainInfo.RPCInfo {
+		merged[url] = info
 	}
-
-	llamaMap := make(map[int64]*LlamaChainHeader)
-	for _, chain := range llamaChains {
-		if chain.ChainID == nil {
-			continue
-		}
-		chainIDNum, exact := toExactInt64(fmt.Sprint(chain.ChainID))
-		if !exact {
-			continue
+	for url, info := range rpcInfo {
+		if _, exists := merged[url]; !exists || overwrite {
+			merged[url] = info
 		}
-		// Check if the chainID already exists in the map
-		if _, exists := llamaMap[chainIDNum]; exists {
-			continue
-		}
-		llamaMap[chainIDNum] = chain
-
-	}
-	return llamaMap, nil
-}
-
-// getDetailLlamaChainInfo fetches RPC info for all chains from chainlist.org
-func getDetailLlamaChainInfo() (map[int64]*LlamaChain, error) {
-	// Send get request to https://chainlist.org
-	resp, err := http.Get("https://chainlist.org")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	// Read the html response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	// Extract the RPC metadata from the html response body, get the substring between start with `{"chains":` and end with `},"__N_SSG":true}` (exclusive), there's only one such substring in the html response body
-	start := []byte(`{"chains":`)
-	end := []byte(`},"__N_SSG":true}`)
-	jsonBody := body[bytes.Index(body, start)+len(start) : bytes.Index(body, end)]
-	// Unmarshal the json string into LlamaChains
-	var llamaChains LlamaChains
-	if err := json.Unmarshal(jsonBody, &llamaChains); err != nil {
-		return nil, err
 	}
-	// Convert LlamaChains to a map for easy lookup
-	llamaChainsMap := make(map[int64]*LlamaChain)
-	for _, chain := range llamaChains {
-		llamaChainsMap[chain.ChainID] = chain
-	}
-	return llamaChainsMap, nil
+	chainInfo.RPCInfo = merged
 }
 
-// mergeRpcInfo merges RPC URLs from LlamaChains into ChainInfo, removing duplicates
-func mergeRpcInfo(chainInfo *ChainInfo, llamaChainDetail *LlamaChain, privateRPCs []string) {
+// mergeRpcURLs appends the urls not yet listed to ChainInfo
+func mergeRpcURLs(chainInfo *ChainInfo, urls []string) {
 	urlMap := make(map[string]bool)
 	for _, url := range chainInfo.RPC {
 		urlMap[url] = true
 	}
-	for _, rpc := range llamaChainDetail.RPC {
-		if _, exists := urlMap[rpc.URL]; !exists {
-			chainInfo.RPC = append(chainInfo.RPC, rpc.URL)
-			urlMap[rpc.URL] = true
-		}
-	}
-	for _, rpc := range privateRPCs {
-		if _, exists := urlMap[rpc]; !exists {
-			chainInfo.RPC = append(chainInfo.RPC, rpc)
-			urlMap[rpc] = true
+	for _, url := range urls {
+		if _, exists := urlMap[url]; !exists {
+			chainInfo.RPC = append(chainInfo.RPC, url)
+			urlMap[url] = true
 		}
 	}
-	chainInfo.LlamaChainDetail = llamaChainDetail
 }
 
 func toExactInt64(n string) (int64, bool) {
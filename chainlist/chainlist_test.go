@@ -0,0 +1,54 @@
+package chainlist
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	chainList, err := NewFileSource(filepath.Join("testdata", "chainid_network.json"), 10, MergeFill).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainList[0].RPCInfo = map[string]*RPCInfo{"https://mainnet.infura.io/v3/${INFURA_API_KEY}": {Tracking: "limited"}}
+	chainList[0].RPC = append(chainList[0].RPC, "ftp://eth.example", "https://")
+
+	normalized, summary := normalize(chainList, map[string]string{"INFURA_API_KEY": "secret"})
+
+	// The deprecated and the red flagged chains are skipped
+	if len(normalized) != 2 || summary[reasonDeprecatedChain] != 1 || summary[reasonRedFlaggedChain] != 1 {
+		t.Fatalf("got %d chains, summary %v", len(normalized), summary)
+	}
+	eth := normalized[0]
+	want := []string{
+		"https://mainnet.infura.io/v3/${INFURA_API_KEY}",
+		"https://api.mycryptoapi.com/eth",
+		"https://cloudflare-eth.com",
+		"https://ethereum-rpc.publicnode.com",
+	}
+	if len(eth.RPC) != len(want) {
+		t.Fatalf("http rpcs = %v, want %v", eth.RPC, want)
+	}
+	for i := range want {
+		if eth.RPC[i] != want[i] {
+			t.Fatalf("http rpcs = %v, want %v", eth.RPC, want)
+		}
+	}
+	// The urls keep their placeholders, so the secret never shows up in the metrics, logs & responses
+	if len(eth.WSRPC) != 2 || eth.WSRPC[0] != "wss://mainnet.infura.io/ws/v3/${INFURA_API_KEY}" {
+		t.Fatalf("websocket rpcs = %v", eth.WSRPC)
+	}
+	if info := eth.RPCInfo["https://mainnet.infura.io/v3/${INFURA_API_KEY}"]; info == nil || info.Tracking != "limited" {
+		t.Fatal("metadata of the url not kept")
+	}
+	if summary[reasonInvalidURL] != 1 || summary[reasonUnsupportedURL] != 1 || summary[reasonWebsocket] != 3 {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+
+	// Without the secret the urls with placeholders are dropped
+	chainList, _ = NewFileSource(filepath.Join("testdata", "chainid_network.json"), 10, MergeFill).Fetch()
+	normalized, summary = normalize(chainList, nil)
+	if len(normalized[0].RPC) != 3 || summary[reasonPlaceholder] != 2 {
+		t.Fatalf("http rpcs = %v, summary %v", normalized[0].RPC, summary)
+	}
+}
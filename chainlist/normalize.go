@@ -0,0 +1,133 @@
+package chainlist
+
+import (
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/logger"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Reasons for filtering rpc urls & chains in the normalization stage
+const (
+	reasonWebsocket        = "websocket"          // moved to the websocket pool
+	reasonPlaceholder      = "placeholder"        // placeholder without operator secret, e.g. ${INFURA_API_KEY}
+	reasonPlaceholderFill  = "placeholder_filled" // placeholder with an operator secret, filled once requests are sent
+	reasonInvalidURL       = "invalid_url"
+	reasonUnsupportedURL   = "unsupported_scheme"
+	reasonDeprecatedChain  = "deprecated_chain"
+	reasonRedFlaggedChain  = "red_flagged_chain"
+	reasonFlaggedChainKept = "flagged_chain_kept"
+)
+
+// normalize sorts the rpc urls of each chain by scheme into the http and websocket pools, keeps the urls with placeholders
+// the operator has secrets for or drops them, and skips deprecated & red flagged chains unless allowed by flags. The urls
+// keep their placeholders, the secrets are only filled in to send requests.
+// It returns the kept chains and the number of urls & chains filtered by reason.
+func normalize(chainList ChainList, secrets map[string]string) (ChainList, map[string]int) {
+	summary := make(map[string]int)
+	kept := make(ChainList, 0, len(chainList))
+	for _, chain := range chainList {
+		if reason := flagReason(chain); reason != "" {
+			if !*flags.AllowFlaggedChains {
+				summary[reason]++
+				logger.Logger.Debug().Int64("chainID", chain.ChainID).Str("reason", reason).Msg("chain skipped")
+				continue
+			}
+			summary[reasonFlaggedChainKept]++
+		}
+
+		httpURLs := make([]string, 0, len(chain.RPC))
+		wsURLs := make([]string, 0)
+		for _, rawURL := range chain.RPC {
+			normalized, reason := normalizeURL(rawURL, secrets)
+			if reason != "" && reason != reasonPlaceholderFill {
+				summary[reason]++
+				logger.Logger.Debug().Int64("chainID", chain.ChainID).Str("url", rawURL).Str("reason", reason).Msg("rpc filtered")
+				if reason != reasonWebsocket {
+					continue
+				}
+			}
+			if reason == reasonPlaceholderFill {
+				summary[reason]++
+			}
+			if reason == reasonWebsocket {
+				wsURLs = append(wsURLs, normalized)
+			} else {
+				httpURLs = append(httpURLs, normalized)
+			}
+		}
+		chain.RPC = httpURLs
+		chain.WSRPC = nil
+		mergeWSURLs(chain, wsURLs)
+		kept = append(kept, chain)
+	}
+	return kept, summary
+}
+
+// flagReason returns why a chain shouldn't be served, or empty if it's fine
+func flagReason(chain *ChainInfo) string {
+	if strings.EqualFold(chain.Status, "deprecated") {
+		return reasonDeprecatedChain
+	}
+	if len(chain.RedFlags) > 0 {
+		return reasonRedFlaggedChain
+	}
+	return ""
+}
+
+// normalizeURL classifies the url, checking it with its placeholders filled. The reason is empty for a usable http url.
+func normalizeURL(rawURL string, secrets map[string]string) (normalized string, reason string) {
+	normalized = strings.TrimSpace(rawURL)
+	filled := normalized
+	if flags.HasSecretPlaceholder(normalized) {
+		var ok bool
+		if filled, ok = flags.FillSecrets(normalized, secrets); !ok {
+			return rawURL, reasonPlaceholder
+		}
+		reason = reasonPlaceholderFill
+	}
+
+	parsed, err := url.Parse(filled)
+	if err != nil || parsed.Host == "" {
+		return rawURL, reasonInvalidURL
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		return normalized, reason
+	case "ws", "wss":
+		return normalized, reasonWebsocket
+	}
+	return rawURL, reasonUnsupportedURL
+}
+
+// mergeWSURLs appends the websocket urls not yet listed to ChainInfo
+func mergeWSURLs(chainInfo *ChainInfo, urls []string) {
+	urlMap := make(map[string]bool)
+	for _, url := range chainInfo.WSRPC {
+		urlMap[url] = true
+	}
+	for _, url := range urls {
+		if !urlMap[url] {
+			chainInfo.WSRPC = append(chainInfo.WSRPC, url)
+			urlMap[url] = true
+		}
+	}
+}
+
+// logSummary logs the number of urls & chains filtered by reason
+func logSummary(summary map[string]int) {
+	if len(summary) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(summary))
+	for reason := range summary {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	event := logger.Logger.Info()
+	for _, reason := range reasons {
+		event = event.Int(reason, summary[reason])
+	}
+	event.Msg("chain registry normalized")
+}
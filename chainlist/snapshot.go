@@ -0,0 +1,48 @@
+package chainlist
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// LoadSnapshot reads a chain list saved by SaveSnapshot, operator rpcs are merged in by Prepare as usual
+func LoadSnapshot(path string) (ChainList, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var chainList ChainList
+	if err := json.Unmarshal(body, &chainList); err != nil {
+		return nil, err
+	}
+	if len(chainList) == 0 {
+		return nil, errors.New("empty chain snapshot: " + path)
+	}
+	return chainList, nil
+}
+
+// SaveSnapshot writes the chain list to path, the file is replaced atomically so a crash never leaves a partial snapshot
+func SaveSnapshot(path string, chainList ChainList) error {
+	body, err := json.Marshal(chainList)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,176 @@
+package chainlist
+
+import (
+	"errors"
+	"github.com/huahuayu/onerpc/logger"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ChainSource is a source of chain registry entries
+type ChainSource interface {
+	// Name identifies the source in logs
+	Name() string
+	// Priority decides which source wins when several MergeFill sources provide the same field, the highest priority wins
+	Priority() int
+	// MergePolicy decides how the entries of the source are merged into the registry
+	MergePolicy() MergePolicy
+	// Fetch returns the chains known to the source, fields the source doesn't know are left empty
+	Fetch() (ChainList, error)
+}
+
+type MergePolicy string
+
+const (
+	// MergeFill adds new chains and fills their fields, the highest priority source wins conflicts
+	MergeFill MergePolicy = "fill"
+	// MergeEnrich only fills the fields other sources left empty, and only for chains known from the other sources
+	MergeEnrich MergePolicy = "enrich"
+	// MergeOverride adds new chains and overwrites the fields of all other sources, e.g. for operator config
+	MergeOverride MergePolicy = "override"
+)
+
+// Registry merges the chain lists of several sources, the rpc urls of all sources are always unioned.
+// A failing source doesn't abort the merge: its last successful result is used instead, or it's skipped and reported
+// as missing.
+type Registry struct {
+	sources  []ChainSource
+	lastGood map[string]ChainList
+	mutex    sync.Mutex
+}
+
+func NewRegistry(sources ...ChainSource) *Registry {
+	return &Registry{
+		sources:  sources,
+		lastGood: make(map[string]ChainList),
+	}
+}
+
+// Fetch fetches all sources and merges them, it only fails if no chain is known from any source. The sources that failed
+// without a last successful result are returned as missing, the chain list is degraded then, e.g. lacks their rpcs.
+func (r *Registry) Fetch() (chainList ChainList, missing []string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Fetch the sources concurrently, the slow chainlist.org scrape shouldn't hold up the others
+	results := make([]ChainList, len(r.sources))
+	errs := make([]error, len(r.sources))
+	var wg sync.WaitGroup
+	for i, source := range r.sources {
+		wg.Add(1)
+		go func(i int, source ChainSource) {
+			defer wg.Done()
+			results[i], errs[i] = source.Fetch()
+		}(i, source)
+	}
+	wg.Wait()
+
+	fetched := make([]fetchedSource, 0, len(r.sources))
+	for i, source := range r.sources {
+		result := results[i]
+		if errs[i] != nil {
+			lastGood, ok := r.lastGood[source.Name()]
+			logger.Logger.Warn().
+				Str("source", source.Name()).
+				Str("error", errs[i].Error()).
+				Bool("lastGood", ok).
+				Msg("chain source failed")
+			if !ok {
+				missing = append(missing, source.Name())
+				continue
+			}
+			result = lastGood
+		} else {
+			r.lastGood[source.Name()] = result
+		}
+		fetched = append(fetched, fetchedSource{source: source, chainList: result})
+	}
+
+	chainList = merge(fetched)
+	if len(chainList) == 0 {
+		return nil, missing, errors.New("no chain available from any chain source")
+	}
+	return chainList, missing, nil
+}
+
+type fetchedSource struct {
+	source    ChainSource
+	chainList ChainList
+}
+
+// merge applies the sources from the lowest to the highest priority, MergeEnrich sources after all others
+func merge(fetched []fetchedSource) ChainList {
+	sort.SliceStable(fetched, func(i, j int) bool {
+		iEnrich := fetched[i].source.MergePolicy() == MergeEnrich
+		jEnrich := fetched[j].source.MergePolicy() == MergeEnrich
+		if iEnrich != jEnrich {
+			return jEnrich
+		}
+		return fetched[i].source.Priority() < fetched[j].source.Priority()
+	})
+
+	chainList := make(ChainList, 0)
+	chainMap := make(map[int64]*ChainInfo)
+	// priorities tracks the priority each chain's fields were last set with, fields set by MergeOverride are never replaced
+	priorities := make(map[int64]int)
+	priorityOf := func(policy MergePolicy, priority int) int {
+		if policy == MergeOverride {
+			return math.MaxInt
+		}
+		return priority
+	}
+	for _, f := range fetched {
+		policy := f.source.MergePolicy()
+		priority := f.source.Priority()
+		for _, chain := range f.chainList {
+			if chain == nil {
+				continue
+			}
+			existing, ok := chainMap[chain.ChainID]
+			if !ok {
+				if policy == MergeEnrich {
+					continue
+				}
+				copied := *chain
+				copied.RPC = append([]string(nil), chain.RPC...)
+				copied.RPCInfo = nil
+				mergeRpcInfo(&copied, chain.RPCInfo, false)
+				chainMap[chain.ChainID] = &copied
+				chainList = append(chainList, &copied)
+				priorities[chain.ChainID] = priorityOf(policy, priority)
+				continue
+			}
+			// Sources are applied in ascending priority, so a fill source overwrites the fields of lower priority ones
+			overwrite := policy == MergeOverride || (policy == MergeFill && priority > priorities[chain.ChainID])
+			mergeFields(existing, chain, overwrite)
+			mergeRpcURLs(existing, chain.RPC)
+			mergeRpcInfo(existing, chain.RPCInfo, overwrite)
+			if overwrite {
+				priorities[chain.ChainID] = priorityOf(policy, priority)
+			}
+		}
+	}
+	return chainList
+}
+
+// mergeFields copies the non-empty fields of src to dst, fields already set on dst are only replaced if overwrite is set.
+// The rpc list and its metadata are merged separately.
+func mergeFields(dst, src *ChainInfo, overwrite bool) {
+	dstValue := reflect.ValueOf(dst).Elem()
+	srcValue := reflect.ValueOf(src).Elem()
+	for i := 0; i < dstValue.NumField(); i++ {
+		name := dstValue.Type().Field(i).Name
+		if name == "RPC" || name == "RPCInfo" || name == "ChainID" {
+			continue
+		}
+		field := srcValue.Field(i)
+		if field.IsZero() {
+			continue
+		}
+		if overwrite || dstValue.Field(i).IsZero() {
+			dstValue.Field(i).Set(field)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package chainlist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newFixtureServer serves the recorded responses in testdata by path, any other path fails with 500
+func newFixtureServer(t *testing.T, fixtures map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fixture, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		body, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func findChain(chainList ChainList, chainID int64) *ChainInfo {
+	for _, chain := range chainList {
+		if chain.ChainID == chainID {
+			return chain
+		}
+	}
+	return nil
+}
+
+func TestChainIDNetworkSource(t *testing.T) {
+	server := newFixtureServer(t, map[string]string{"/chains.json": "chainid_network.json"})
+	chainList, err := (&ChainIDNetworkSource{URL: server.URL + "/chains.json"}).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chainList) != 4 {
+		t.Fatalf("got %d chains, want 4", len(chainList))
+	}
+	if eth := findChain(chainList, 1); eth == nil || eth.ShortName != "eth" || len(eth.RPC) != 6 {
+		t.Fatalf("unexpected ethereum entry %+v", eth)
+	}
+}
+
+func TestLlamaChainsSource(t *testing.T) {
+	server := newFixtureServer(t, map[string]string{"/v2/chains": "llama_chains.json"})
+	chainList, err := (&LlamaChainsSource{URL: server.URL + "/v2/chains"}).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry without chainId is skipped, only the first entry of chain 1 is used
+	if len(chainList) != 2 {
+		t.Fatalf("got %d chains, want 2", len(chainList))
+	}
+	if eth := findChain(chainList, 1); eth == nil || eth.Tvl != 53561932829.31 || eth.LlamaChainHeader.Name != "Ethereum" {
+		t.Fatalf("unexpected ethereum entry %+v", eth)
+	}
+}
+
+func TestChainlistOrgSource(t *testing.T) {
+	server := newFixtureServer(t, map[string]string{"/": "chainlist_org.html"})
+	chainList, err := (&ChainlistOrgSource{URL: server.URL + "/"}).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chainList) != 3 {
+		t.Fatalf("got %d chains, want 3", len(chainList))
+	}
+	eth := findChain(chainList, 1)
+	if eth == nil || len(eth.RPC) != 4 || eth.LlamaChainDetail == nil || eth.LlamaChainDetail.RPC[1].Tracking != "yes" {
+		t.Fatalf("unexpected ethereum entry %+v", eth)
+	}
+}
+
+func TestChainlistOrgSourceMissingMarker(t *testing.T) {
+	server := newFixtureServer(t, map[string]string{"/": "registry.json"})
+	if _, err := (&ChainlistOrgSource{URL: server.URL + "/"}).Fetch(); err == nil {
+		t.Fatal("expected an error for a page without chain data")
+	}
+}
+
+func TestHTTPAndFileSource(t *testing.T) {
+	server := newFixtureServer(t, map[string]string{"/registry.json": "registry.json"})
+	for _, source := range []ChainSource{
+		NewHTTPSource(server.URL+"/registry.json", 50, MergeFill),
+		NewFileSource(filepath.Join("testdata", "registry.json"), 40, MergeFill),
+	} {
+		chainList, err := source.Fetch()
+		if err != nil {
+			t.Fatal(source.Name(), err)
+		}
+		if len(chainList) != 2 || findChain(chainList, 31337) == nil {
+			t.Fatalf("%s: unexpected chain list", source.Name())
+		}
+	}
+	if _, err := NewFileSource(filepath.Join("testdata", "missing.json"), 40, MergeFill).Fetch(); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestRegistryMerge(t *testing.T) {
+	server := newFixtureServer(t, map[string]string{
+		"/chains.json":   "chainid_network.json",
+		"/v2/chains":     "llama_chains.json",
+		"/":              "chainlist_org.html",
+		"/registry.json": "registry.json",
+	})
+	static := ChainList{{ChainID: 56, Name: "BSC", RPC: []string{"https://bsc.operator.example"}}}
+	registry := NewRegistry(
+		&ChainIDNetworkSource{URL: server.URL + "/chains.json"},
+		&LlamaChainsSource{URL: server.URL + "/v2/chains"},
+		&ChainlistOrgSource{URL: server.URL + "/"},
+		NewHTTPSource(server.URL+"/registry.json", 50, MergeFill),
+		NewStaticSource(static, 100, MergeOverride),
+	)
+	chainList, missing, err := registry.Fetch()
+	if err != nil || len(missing) != 0 {
+		t.Fatal(err, missing)
+	}
+
+	// chainid.network chains plus the devnet of our own registry, the chain only known to chainlist.org is not added
+	if len(chainList) != 5 || findChain(chainList, 424242) != nil {
+		t.Fatalf("got %d chains, want 5", len(chainList))
+	}
+	eth := findChain(chainList, 1)
+	if eth.Name != "Ethereum" {
+		t.Fatalf("name = %s, want the name of the higher priority registry", eth.Name)
+	}
+	if eth.Tvl != 53561932829.31 || eth.LlamaChainDetail == nil || eth.Icon != "ethereum" {
+		t.Fatalf("ethereum not enriched: %+v", eth)
+	}
+	// 6 from chainid.network, 2 new from chainlist.org, 1 from our own registry
+	if len(eth.RPC) != 9 {
+		t.Fatalf("got %d ethereum rpcs, want 9: %v", len(eth.RPC), eth.RPC)
+	}
+	if info := eth.RPCInfo["https://cloudflare-eth.com"]; info == nil || info.Tracking != "yes" {
+		t.Fatalf("tracking metadata not kept: %+v", info)
+	}
+	if bsc := findChain(chainList, 56); bsc.Name != "BSC" || bsc.ShortName != "bnb" || len(bsc.RPC) != 5 {
+		t.Fatalf("static chain not merged: %+v", bsc)
+	}
+}
+
+func TestRegistryDegradesGracefully(t *testing.T) {
+	fixtures := map[string]string{
+		"/chains.json": "chainid_network.json",
+		"/v2/chains":   "llama_chains.json",
+	}
+	server := newFixtureServer(t, fixtures)
+	registry := NewRegistry(
+		&ChainIDNetworkSource{URL: server.URL + "/chains.json"},
+		&LlamaChainsSource{URL: server.URL + "/v2/chains"},
+		&ChainlistOrgSource{URL: server.URL + "/"}, // always fails
+	)
+	chainList, missing, err := registry.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eth := findChain(chainList, 1); eth == nil || eth.Tvl == 0 {
+		t.Fatal("a failing source should not abort the merge")
+	}
+	// The chain list is degraded, chainlist.org never succeeded
+	if len(missing) != 1 || missing[0] != (&ChainlistOrgSource{}).Name() {
+		t.Fatalf("missing %v, want chainlist.org", missing)
+	}
+
+	// The last good result of a source is used once it fails, it's not missing
+	delete(fixtures, "/v2/chains")
+	chainList, missing, err = registry.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eth := findChain(chainList, 1); eth == nil || eth.Tvl == 0 {
+		t.Fatal("last good result not used")
+	}
+	if len(missing) != 1 {
+		t.Fatalf("missing %v, want only chainlist.org", missing)
+	}
+
+	// Without any chain from any source, the fetch fails
+	if _, _, err := NewRegistry(&ChainIDNetworkSource{URL: server.URL + "/missing"}).Fetch(); err == nil {
+		t.Fatal("expected an error without any chain")
+	}
+}
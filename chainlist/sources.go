@@ -0,0 +1,211 @@
+package chainlist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	ChainIDNetworkURL = "https://chainid.network/chains.json"
+	LlamaChainsURL    = "https://api.llama.fi/v2/chains"
+	ChainlistOrgURL   = "https://chainlist.org"
+)
+
+var sourceClient = &http.Client{Timeout: 30 * time.Second}
+
+// ChainIDNetworkSource is the chain list of https://chainid.network/chains.json, the base of the registry
+type ChainIDNetworkSource struct {
+	URL string
+}
+
+func (s *ChainIDNetworkSource) Name() string             { return "chainid.network" }
+func (s *ChainIDNetworkSource) Priority() int            { return 10 }
+func (s *ChainIDNetworkSource) MergePolicy() MergePolicy { return MergeFill }
+
+func (s *ChainIDNetworkSource) Fetch() (ChainList, error) {
+	body, err := httpGet(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	var chainList ChainList
+	if err := json.Unmarshal(body, &chainList); err != nil {
+		return nil, err
+	}
+	return chainList, nil
+}
+
+// LlamaChainsSource is the chain header list of https://api.llama.fi/v2/chains, it adds the Tvl to known chains
+type LlamaChainsSource struct {
+	URL string
+}
+
+func (s *LlamaChainsSource) Name() string             { return "api.llama.fi" }
+func (s *LlamaChainsSource) Priority() int            { return 20 }
+func (s *LlamaChainsSource) MergePolicy() MergePolicy { return MergeEnrich }
+
+func (s *LlamaChainsSource) Fetch() (ChainList, error) {
+	body, err := httpGet(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	var llamaChains LlamaChainHeaders
+	if err := json.Unmarshal(body, &llamaChains); err != nil {
+		return nil, err
+	}
+
+	chainList := make(ChainList, 0, len(llamaChains))
+	seen := make(map[int64]bool)
+	for _, chain := range llamaChains {
+		if chain.ChainID == nil {
+			continue
+		}
+		chainIDNum, exact := toExactInt64(fmt.Sprint(chain.ChainID))
+		if !exact {
+			continue
+		}
+		// Only the first entry of a chainID is used
+		if seen[chainIDNum] {
+			continue
+		}
+		seen[chainIDNum] = true
+		chainList = append(chainList, &ChainInfo{ChainID: chainIDNum, Tvl: chain.Tvl, LlamaChainHeader: chain})
+	}
+	return chainList, nil
+}
+
+// ChainlistOrgSource is the chain detail list scraped from https://chainlist.org, it adds the rpcs and their tracking
+// metadata to known chains
+type ChainlistOrgSource struct {
+	URL string
+}
+
+func (s *ChainlistOrgSource) Name() string             { return "chainlist.org" }
+func (s *ChainlistOrgSource) Priority() int            { return 30 }
+func (s *ChainlistOrgSource) MergePolicy() MergePolicy { return MergeEnrich }
+
+func (s *ChainlistOrgSource) Fetch() (ChainList, error) {
+	body, err := httpGet(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	// Extract the RPC metadata from the html response body, get the substring between start with `{"chains":` and end with `},"__N_SSG":true}` (exclusive), there's only one such substring in the html response body
+	start := []byte(`{"chains":`)
+	end := []byte(`},"__N_SSG":true}`)
+	startIndex := bytes.Index(body, start)
+	if startIndex < 0 {
+		return nil, errors.New("chain data start marker not found")
+	}
+	startIndex += len(start)
+	endIndex := bytes.Index(body[startIndex:], end)
+	if endIndex < 0 {
+		return nil, errors.New("chain data end marker not found")
+	}
+	var llamaChains LlamaChains
+	if err := json.Unmarshal(body[startIndex:startIndex+endIndex], &llamaChains); err != nil {
+		return nil, err
+	}
+
+	chainList := make(ChainList, 0, len(llamaChains))
+	for _, chain := range llamaChains {
+		chainInfo := &ChainInfo{ChainID: chain.ChainID, LlamaChainDetail: chain, RPCInfo: make(map[string]*RPCInfo)}
+		for _, rpc := range chain.RPC {
+			chainInfo.RPC = append(chainInfo.RPC, rpc.URL)
+			chainInfo.RPCInfo[rpc.URL] = &RPCInfo{
+				Tracking:        rpc.Tracking,
+				TrackingDetails: rpc.TrackingDetails,
+				IsOpenSource:    rpc.IsOpenSource,
+			}
+		}
+		chainList = append(chainList, chainInfo)
+	}
+	return chainList, nil
+}
+
+// FileSource is a chain list in a local json file, in the format of https://chainid.network/chains.json
+type FileSource struct {
+	path     string
+	priority int
+	policy   MergePolicy
+}
+
+func NewFileSource(path string, priority int, policy MergePolicy) *FileSource {
+	return &FileSource{path: path, priority: priority, policy: policy}
+}
+
+func (s *FileSource) Name() string             { return "file:" + s.path }
+func (s *FileSource) Priority() int            { return s.priority }
+func (s *FileSource) MergePolicy() MergePolicy { return s.policy }
+
+func (s *FileSource) Fetch() (ChainList, error) {
+	body, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var chainList ChainList
+	if err := json.Unmarshal(body, &chainList); err != nil {
+		return nil, err
+	}
+	return chainList, nil
+}
+
+// HTTPSource is a chain list served over http, in the format of https://chainid.network/chains.json, e.g. our own registry
+type HTTPSource struct {
+	url      string
+	priority int
+	policy   MergePolicy
+}
+
+func NewHTTPSource(url string, priority int, policy MergePolicy) *HTTPSource {
+	return &HTTPSource{url: url, priority: priority, policy: policy}
+}
+
+func (s *HTTPSource) Name() string             { return s.url }
+func (s *HTTPSource) Priority() int            { return s.priority }
+func (s *HTTPSource) MergePolicy() MergePolicy { return s.policy }
+
+func (s *HTTPSource) Fetch() (ChainList, error) {
+	body, err := httpGet(s.url)
+	if err != nil {
+		return nil, err
+	}
+	var chainList ChainList
+	if err := json.Unmarshal(body, &chainList); err != nil {
+		return nil, err
+	}
+	return chainList, nil
+}
+
+// StaticSource is a chain list from the operator config
+type StaticSource struct {
+	chains   ChainList
+	priority int
+	policy   MergePolicy
+}
+
+func NewStaticSource(chains ChainList, priority int, policy MergePolicy) *StaticSource {
+	return &StaticSource{chains: chains, priority: priority, policy: policy}
+}
+
+func (s *StaticSource) Name() string              { return "static" }
+func (s *StaticSource) Priority() int             { return s.priority }
+func (s *StaticSource) MergePolicy() MergePolicy  { return s.policy }
+func (s *StaticSource) Fetch() (ChainList, error) { return s.chains, nil }
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := sourceClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: status code %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
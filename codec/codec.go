@@ -0,0 +1,211 @@
+// Package codec compresses & decompresses http bodies by their content encoding
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	Identity = ""
+	Gzip     = "gzip"
+	Zstd     = "zstd"
+	Brotli   = "br"
+)
+
+// Supported are the supported content encodings in order of preference
+var Supported = []string{Zstd, Brotli, Gzip}
+
+// brotliQuality trades the compression ratio for speed, brotli bodies are compressed per use, see EncodePrefixed
+const brotliQuality = 4
+
+// AcceptEncoding is the Accept-Encoding header offering the supported encodings
+var AcceptEncoding = strings.Join(Supported, ", ")
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	flateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	brotliWriters = sync.Pool{New: func() any {
+		return brotli.NewWriterLevel(nil, brotliQuality)
+	}}
+	// The zstd encoder & decoder are safe for concurrent EncodeAll & DecodeAll calls
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedSize))
+)
+
+// maxDecodedSize bounds decoded bodies, so a small compressed body can't exhaust the memory
+const maxDecodedSize = 256 << 20
+
+// Encode compresses data in the encoding
+func Encode(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case Identity:
+		return data, nil
+	case Gzip:
+		var buffer bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buffer)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/4)), nil
+	case Brotli:
+		var buffer bytes.Buffer
+		w := brotliWriters.Get().(*brotli.Writer)
+		defer brotliWriters.Put(w)
+		w.Reset(&buffer)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// EncodeSuffix compresses data to be served after prefixes compressed per use by EncodePrefixed
+func EncodeSuffix(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case Gzip:
+		// A raw deflate stream ending in the final block, framed by EncodePrefixed
+		var buffer bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(&buffer)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case Brotli:
+		// Brotli streams can't be joined, EncodePrefixed compresses the whole body
+		return nil, nil
+	default:
+		return Encode(encoding, data)
+	}
+}
+
+// EncodePrefixed compresses prefix followed by suffix, given the suffix compressed by EncodeSuffix, compressing only the
+// prefix. Zstd frames are concatenated; gzip gets a single member, as clients like curl ignore any but the first, of the
+// prefix deflated up to a sync flush followed by the suffix stream, whose back references stay within the suffix. Brotli
+// has neither, so prefix & suffix are compressed as a whole.
+func EncodePrefixed(encoding string, prefix, suffix, encodedSuffix []byte) ([]byte, error) {
+	switch encoding {
+	case Identity:
+		return append(append([]byte{}, prefix...), suffix...), nil
+	case Gzip:
+		buffer := bytes.NewBuffer(make([]byte, 0, len(prefix)+len(encodedSuffix)+32))
+		// The header without name, comment or modification time, as written by gzip.Writer
+		buffer.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff})
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(buffer)
+		if _, err := w.Write(prefix); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		buffer.Write(encodedSuffix)
+		crc := crc32.Update(crc32.ChecksumIEEE(prefix), crc32.IEEETable, suffix)
+		buffer.Write(binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, crc), uint32(len(prefix)+len(suffix))))
+		return buffer.Bytes(), nil
+	case Zstd:
+		return append(zstdEncoder.EncodeAll(prefix, make([]byte, 0, len(prefix)+len(encodedSuffix))), encodedSuffix...), nil
+	case Brotli:
+		return Encode(Brotli, append(append(make([]byte, 0, len(prefix)+len(suffix)), prefix...), suffix...))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// Decode decompresses data in the encoding, the identity encoding is also accepted by its name
+func Decode(encoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case Identity, "identity":
+		return data, nil
+	case Gzip, "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r)
+	case Brotli:
+		return readLimited(brotli.NewReader(bytes.NewReader(data)))
+	case Zstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// readLimited reads the decoded body, failing if it exceeds maxDecodedSize
+func readLimited(r io.Reader) ([]byte, error) {
+	decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxDecodedSize {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", maxDecodedSize)
+	}
+	return decoded, nil
+}
+
+// Negotiate returns the preferred supported encoding accepted by the Accept-Encoding header, Identity if none is
+func Negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return Identity
+	}
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	best, bestQ := Identity, 0.0
+	for _, encoding := range Supported {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`), 100)
+	for _, encoding := range append(Supported, Identity) {
+		encoded, err := Encode(encoding, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != Identity && len(encoded) >= len(data) {
+			t.Errorf("%s: encoded %d bytes into %d", encoding, len(data), len(encoded))
+		}
+		decoded, err := Decode(encoding, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: round trip mismatch", encoding)
+		}
+	}
+	if _, err := Decode("compress", data); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
+
+func TestDecodeOversized(t *testing.T) {
+	// Streamed in chunks, the frame doesn't declare its size up front
+	for _, encoding := range Supported {
+		var buffer bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case Zstd:
+			w, _ = zstd.NewWriter(&buffer)
+		case Brotli:
+			w = brotli.NewWriterLevel(&buffer, brotli.BestSpeed)
+		default:
+			w = gzip.NewWriter(&buffer)
+		}
+		chunk := make([]byte, 1<<20)
+		for i := 0; i <= maxDecodedSize>>20; i++ {
+			w.Write(chunk)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Decode(encoding, buffer.Bytes()); err == nil {
+			t.Errorf("%s: decoded a body over %d bytes", encoding, maxDecodedSize)
+		}
+	}
+}
+
+func TestEncodePrefixed(t *testing.T) {
+	prefix, suffix := []byte(`{"jsonrpc":"2.0","id":7`), bytes.Repeat([]byte(`,"result":"0x1"`), 100)
+	want := append(append([]byte{}, prefix...), suffix...)
+	for _, encoding := range append(Supported, Identity) {
+		encodedSuffix, err := EncodeSuffix(encoding, suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := EncodePrefixed(encoding, prefix, suffix, encodedSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(encoding, encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, want) {
+			t.Errorf("%s: decoded %q", encoding, decoded)
+		}
+	}
+
+	// gzip is a single member, clients may not read past the first
+	encodedSuffix, _ := EncodeSuffix(Gzip, suffix)
+	encoded, _ := EncodePrefixed(Gzip, prefix, suffix, encodedSuffix)
+	r, err := gzip.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Multistream(false)
+	if decoded, err := io.ReadAll(r); err != nil || !bytes.Equal(decoded, want) {
+		t.Fatalf("first gzip member: %q, %v", decoded, err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", Identity},
+		{"gzip, deflate", Gzip},
+		{"gzip, deflate, br", Brotli},
+		{"gzip, deflate, br, zstd", Zstd},
+		{"gzip, zstd", Zstd},
+		{"zstd;q=0.5, gzip", Gzip},
+		{"zstd;q=0, gzip;q=0", Identity},
+		{"*", Zstd},
+		{"br", Brotli},
+		{"compress", Identity},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.acceptEncoding); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
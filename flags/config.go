@@ -0,0 +1,680 @@
+package flags
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the config file, every setting is optional and the flags & env variables override it.
+// See config.example.yaml for all settings.
+type Config struct {
+	Server      ServerConfig      `yaml:"server"`
+	Log         LogConfig         `yaml:"log"`
+	Registry    RegistryConfig    `yaml:"registry"`
+	Chains      []ChainConfig     `yaml:"chains"`
+	Cache       CacheConfig       `yaml:"cache"`
+	Compression CompressionConfig `yaml:"compression"`
+	Coalescing  CoalescingConfig  `yaml:"coalescing"`
+	RateLimit   RateLimitConfig   `yaml:"rateLimit"`
+	Methods     MethodsConfig     `yaml:"methods"`
+	Timeouts    TimeoutsConfig    `yaml:"timeouts"`
+	HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+	Replica     int               `yaml:"replica"`
+}
+
+type ServerConfig struct {
+	Port          string          `yaml:"port"`
+	Metrics       bool            `yaml:"metrics"`
+	MetricsPort   string          `yaml:"metricsPort"`
+	Dashboard     bool            `yaml:"dashboard"`
+	DashboardPort string          `yaml:"dashboardPort"`
+	Pprof         bool            `yaml:"pprof"`
+	AdminToken    string          `yaml:"adminToken"`
+	Readiness     ReadinessConfig `yaml:"readiness"`
+	TLS           TLSConfig       `yaml:"tls"`
+	H2C           bool            `yaml:"h2c"`
+}
+
+type TLSConfig struct {
+	Cert              string            `yaml:"cert"`
+	Key               string            `yaml:"key"`
+	ClientCA          string            `yaml:"clientCA"`
+	RequireClientCert bool              `yaml:"requireClientCert"`
+	ClientCertKeys    map[string]string `yaml:"clientCertKeys"` // api keys by certificate common name or SAN
+	ACME              ACMEConfig        `yaml:"acme"`
+}
+
+type ACMEConfig struct {
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email"`
+	CacheDir     string   `yaml:"cacheDir"`
+	DirectoryURL string   `yaml:"directoryURL"` // empty: Let's Encrypt
+}
+
+type ReadinessConfig struct {
+	Chains       []int64 `yaml:"chains"`       // chains that need healthy upstreams for /readyz to pass
+	MinUpstreams int     `yaml:"minUpstreams"` // 0: 1
+}
+
+type LogConfig struct {
+	Level  *int `yaml:"level"`
+	Caller bool `yaml:"caller"`
+}
+
+type RegistryConfig struct {
+	Snapshot           *string           `yaml:"snapshot"` // empty: disabled
+	Offline            bool              `yaml:"offline"`
+	File               string            `yaml:"file"`
+	URL                string            `yaml:"url"`
+	AllowFlaggedChains bool              `yaml:"allowFlaggedChains"`
+	PrivacyPolicy      string            `yaml:"privacyPolicy"`
+	Aliases            map[string]int64  `yaml:"aliases"`
+	Secrets            map[string]string `yaml:"secrets"`
+	StaticChains       []map[string]any  `yaml:"staticChains"`
+}
+
+// ChainConfig holds the upstreams & policy of a chain
+type ChainConfig struct {
+	ChainID             int64            `yaml:"chainID"`
+	Upstreams           []UpstreamConfig `yaml:"upstreams"`
+	Fallbacks           []string         `yaml:"fallbacks"`
+	RegistryTier        int              `yaml:"registryTier"`
+	MaxLagBlocks        *int64           `yaml:"maxLagBlocks"`        // 0: no limit, unset: healthCheck's
+	MaxLagSeconds       *int64           `yaml:"maxLagSeconds"`       // 0: no limit, unset: healthCheck's
+	HealthCheckInterval Duration         `yaml:"healthCheckInterval"` // 0: healthCheck's
+	NewHeadsURL         string           `yaml:"newHeadsURL"`
+}
+
+type UpstreamConfig struct {
+	URL      string `yaml:"url"`
+	Weight   int    `yaml:"weight"`
+	Tier     int    `yaml:"tier"`
+	Tracking string `yaml:"tracking"` // none, limited or yes
+}
+
+type CacheConfig struct {
+	TTL      Duration            `yaml:"ttl"`
+	Methods  []string            `yaml:"methods"`
+	Stale    CacheStaleConfig    `yaml:"stale"`
+	Rules    []CacheRuleConfig   `yaml:"rules"`
+	Negative CacheNegativeConfig `yaml:"negative"`
+}
+
+// CacheNegativeConfig caches the not found results of the lookups briefly, to absorb polling for pending transactions
+type CacheNegativeConfig struct {
+	TTL     Duration `yaml:"ttl"` // 0: disabled
+	Methods []string `yaml:"methods"`
+}
+
+// CacheRuleConfig is the cache policy of a method on a chain, or on every chain without a chain
+type CacheRuleConfig struct {
+	Chain       int64    `yaml:"chain"`
+	Method      string   `yaml:"method"`
+	TTL         Duration `yaml:"ttl"`         // 0: cache.ttl
+	BlockParam  string   `yaml:"blockParam"`  // number, hash or fixed (either), empty: any
+	MaxSize     int      `yaml:"maxSize"`     // bytes, 0: no limit
+	NegativeTTL Duration `yaml:"negativeTTL"` // 0: empty & null results aren't cached
+}
+
+func (r CacheRuleConfig) rule() CacheRule {
+	return CacheRule{
+		ChainID:     r.Chain,
+		Method:      r.Method,
+		TTL:         int64(time.Duration(r.TTL) / time.Second),
+		BlockParam:  r.BlockParam,
+		MaxSize:     r.MaxSize,
+		NegativeTTL: int64(time.Duration(r.NegativeTTL) / time.Second),
+	}
+}
+
+// CacheStaleConfig keeps expired responses of the methods to serve within the windows after the TTL
+type CacheStaleConfig struct {
+	WhileRevalidate Duration `yaml:"whileRevalidate"` // served at once while refreshed in the background
+	IfError         Duration `yaml:"ifError"`         // served when all upstreams fail
+	Methods         []string `yaml:"methods"`
+}
+
+type RateLimitConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	WithoutAuth *int     `yaml:"withoutAuth"`
+	WithAuth    *int     `yaml:"withAuth"` // 0: no limit
+	Keys        []string `yaml:"keys"`
+}
+
+type CompressionConfig struct {
+	Enabled  *bool `yaml:"enabled"` // nil: true
+	MinSize  int   `yaml:"minSize"`
+	Upstream *bool `yaml:"upstream"` // nil: true
+}
+
+type CoalescingConfig struct {
+	Enabled        *bool    `yaml:"enabled"`        // nil: true
+	ExcludeMethods []string `yaml:"excludeMethods"` // empty: the default of uncoalescedMethods
+}
+
+type MethodsConfig struct {
+	Allow []string `yaml:"allow"` // empty: all methods not denied
+	Deny  []string `yaml:"deny"`
+}
+
+type TimeoutsConfig struct {
+	RPC           Duration `yaml:"rpc"`
+	Shutdown      Duration `yaml:"shutdown"`
+	ShutdownDelay Duration `yaml:"shutdownDelay"`
+}
+
+type HealthCheckConfig struct {
+	Interval        Duration `yaml:"interval"`
+	IdleInterval    Duration `yaml:"idleInterval"`
+	MaxBackoff      Duration `yaml:"maxBackoff"`
+	Concurrency     int      `yaml:"concurrency"`
+	ChainIDInterval Duration `yaml:"chainIDInterval"`
+	MaxLagBlocks    *int64   `yaml:"maxLagBlocks"`  // 0: no limit
+	MaxLagSeconds   *int64   `yaml:"maxLagSeconds"` // 0: no limit
+}
+
+// Duration is a time.Duration written as a string like 30s or 5m in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	duration, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q, should be like 30s or 5m", value.Line, value.Value)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// LoadConfig reads & validates the config file, unknown settings are errors
+func LoadConfig(path string) (*Config, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(body))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s:\n%w", path, err)
+	}
+	return &config, nil
+}
+
+// Validate checks all settings, the error lists every invalid setting by its path
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	for path, port := range map[string]string{
+		"server.port":          c.Server.Port,
+		"server.metricsPort":   c.Server.MetricsPort,
+		"server.dashboardPort": c.Server.DashboardPort,
+	} {
+		if port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			fail(path, "invalid port %q", port)
+		}
+	}
+	if c.Server.Metrics && c.Server.MetricsPort == "" {
+		fail("server.metricsPort", "required if metrics is enabled")
+	}
+	if c.Server.Dashboard && c.Server.DashboardPort == "" {
+		fail("server.dashboardPort", "required if dashboard is enabled")
+	}
+	tlsConfig := c.Server.TLS
+	if (tlsConfig.Cert == "") != (tlsConfig.Key == "") {
+		fail("server.tls", "cert and key are required together")
+	}
+	if tlsConfig.Cert != "" && len(tlsConfig.ACME.Domains) > 0 {
+		fail("server.tls", "cert and acme are mutually exclusive")
+	}
+	if (tlsConfig.RequireClientCert || len(tlsConfig.ClientCertKeys) > 0) && tlsConfig.ClientCA == "" {
+		fail("server.tls.clientCA", "required for requireClientCert and clientCertKeys")
+	}
+	if tlsConfig.ACME.DirectoryURL != "" {
+		if err := checkURL(tlsConfig.ACME.DirectoryURL, "https", "http"); err != nil {
+			fail("server.tls.acme.directoryURL", "%v", err)
+		}
+	}
+	if c.Compression.MinSize < 0 {
+		fail("compression.minSize", "should not be negative")
+	}
+	if c.Server.Readiness.MinUpstreams < 0 {
+		fail("server.readiness.minUpstreams", "should not be negative")
+	}
+	for i, chainID := range c.Server.Readiness.Chains {
+		if chainID <= 0 {
+			fail(fmt.Sprintf("server.readiness.chains[%d]", i), "invalid chain ID %d", chainID)
+		}
+	}
+	if c.Log.Level != nil && (*c.Log.Level < -1 || *c.Log.Level > 5) {
+		fail("log.level", "should be between -1 (trace) and 5 (panic), got %d", *c.Log.Level)
+	}
+
+	switch c.Registry.PrivacyPolicy {
+	case "", "none", "limited", "no-yes", "any":
+	default:
+		fail("registry.privacyPolicy", "invalid policy %q, should be one of none, limited, no-yes, any", c.Registry.PrivacyPolicy)
+	}
+	if c.Registry.URL != "" {
+		if err := checkURL(c.Registry.URL, "http", "https"); err != nil {
+			fail("registry.url", "%v", err)
+		}
+	}
+	if c.Registry.Offline && c.Registry.Snapshot != nil && *c.Registry.Snapshot == "" {
+		fail("registry.snapshot", "required in offline mode")
+	}
+	for name, chainID := range c.Registry.Aliases {
+		if chainID <= 0 {
+			fail("registry.aliases."+name, "invalid chain ID %d", chainID)
+		}
+	}
+	for i, chain := range c.Registry.StaticChains {
+		if _, ok := chain["chainId"]; !ok {
+			fail(fmt.Sprintf("registry.staticChains[%d]", i), "chainId is required")
+		}
+	}
+
+	seenChains := make(map[int64]bool)
+	for i, chain := range c.Chains {
+		path := fmt.Sprintf("chains[%d]", i)
+		if chain.ChainID <= 0 {
+			fail(path+".chainID", "required and should be positive")
+		} else if seenChains[chain.ChainID] {
+			fail(path+".chainID", "duplicate chain %d", chain.ChainID)
+		}
+		seenChains[chain.ChainID] = true
+		seenURLs := make(map[string]bool)
+		for j, upstream := range chain.Upstreams {
+			upstreamPath := fmt.Sprintf("%s.upstreams[%d]", path, j)
+			if err := checkURL(upstream.URL, "http", "https"); err != nil {
+				fail(upstreamPath+".url", "%v", err)
+			} else if seenURLs[upstream.URL] {
+				fail(upstreamPath+".url", "duplicate upstream %s", upstream.URL)
+			}
+			seenURLs[upstream.URL] = true
+			if upstream.Weight < 0 {
+				fail(upstreamPath+".weight", "should not be negative")
+			}
+			if upstream.Tier < 0 {
+				fail(upstreamPath+".tier", "should not be negative")
+			}
+			if upstream.Tracking != "" && upstream.Tracking != "none" && upstream.Tracking != "limited" && upstream.Tracking != "yes" {
+				fail(upstreamPath+".tracking", "should be none, limited or yes, got %q", upstream.Tracking)
+			}
+		}
+		for j, fallback := range chain.Fallbacks {
+			if err := checkURL(fallback, "http", "https"); err != nil {
+				fail(fmt.Sprintf("%s.fallbacks[%d]", path, j), "%v", err)
+			}
+		}
+		if chain.RegistryTier < 0 {
+			fail(path+".registryTier", "should not be negative")
+		}
+		if chain.MaxLagBlocks != nil && *chain.MaxLagBlocks < 0 {
+			fail(path+".maxLagBlocks", "should not be negative")
+		}
+		if chain.MaxLagSeconds != nil && *chain.MaxLagSeconds < 0 {
+			fail(path+".maxLagSeconds", "should not be negative")
+		}
+		if err := checkDuration(chain.HealthCheckInterval, time.Second); err != nil {
+			fail(path+".healthCheckInterval", "%v", err)
+		}
+		if chain.NewHeadsURL != "" {
+			if err := checkURL(chain.NewHeadsURL, "ws", "wss"); err != nil {
+				fail(path+".newHeadsURL", "%v", err)
+			}
+		}
+	}
+
+	if err := checkDuration(c.Cache.TTL, time.Minute); err != nil {
+		fail("cache.ttl", "%v", err)
+	}
+	for i, method := range c.Cache.Methods {
+		if strings.TrimSpace(method) == "" {
+			fail(fmt.Sprintf("cache.methods[%d]", i), "empty method")
+		}
+	}
+	if err := checkDuration(c.Cache.Stale.WhileRevalidate, time.Second); err != nil {
+		fail("cache.stale.whileRevalidate", "%v", err)
+	}
+	if err := checkDuration(c.Cache.Stale.IfError, time.Second); err != nil {
+		fail("cache.stale.ifError", "%v", err)
+	}
+	seenRules := make(map[CacheRule]bool)
+	for i, rule := range c.Cache.Rules {
+		path := fmt.Sprintf("cache.rules[%d]", i)
+		if err := checkDuration(rule.TTL, time.Second); err != nil {
+			fail(path+".ttl", "%v", err)
+		}
+		if err := checkDuration(rule.NegativeTTL, time.Second); err != nil {
+			fail(path+".negativeTTL", "%v", err)
+		}
+		if err := rule.rule().validate(); err != nil {
+			fail(path, "%v", err)
+		}
+		key := CacheRule{ChainID: rule.Chain, Method: rule.Method}
+		if seenRules[key] {
+			fail(path, "duplicate rule of %s on chain %d", rule.Method, rule.Chain)
+		}
+		seenRules[key] = true
+	}
+	if err := checkDuration(c.Cache.Negative.TTL, time.Second); err != nil {
+		fail("cache.negative.ttl", "%v", err)
+	}
+	for i, method := range c.Cache.Negative.Methods {
+		if strings.TrimSpace(method) == "" {
+			fail(fmt.Sprintf("cache.negative.methods[%d]", i), "empty method")
+		}
+	}
+	for i, method := range c.Cache.Stale.Methods {
+		if strings.TrimSpace(method) == "" {
+			fail(fmt.Sprintf("cache.stale.methods[%d]", i), "empty method")
+		}
+	}
+
+	if c.RateLimit.WithoutAuth != nil && *c.RateLimit.WithoutAuth < 0 {
+		fail("rateLimit.withoutAuth", "should not be negative")
+	}
+	if c.RateLimit.WithAuth != nil && *c.RateLimit.WithAuth < 0 {
+		fail("rateLimit.withAuth", "should not be negative")
+	}
+	seenKeys := make(map[string]bool)
+	for i, key := range c.RateLimit.Keys {
+		path := fmt.Sprintf("rateLimit.keys[%d]", i)
+		if len(key) < 16 || strings.ContainsAny(key, "/ ,") {
+			fail(path, "should be at least 16 characters without slashes, commas or spaces")
+		} else if seenKeys[key] {
+			fail(path, "duplicate key")
+		}
+		seenKeys[key] = true
+	}
+
+	denied := make(map[string]bool)
+	for _, method := range c.Methods.Deny {
+		denied[method] = true
+	}
+	for i, method := range c.Methods.Allow {
+		if denied[method] {
+			fail(fmt.Sprintf("methods.allow[%d]", i), "%s is also denied", method)
+		}
+	}
+
+	for path, d := range map[string]Duration{
+		"timeouts.rpc":           c.Timeouts.RPC,
+		"timeouts.shutdown":      c.Timeouts.Shutdown,
+		"timeouts.shutdownDelay": c.Timeouts.ShutdownDelay,
+	} {
+		if err := checkDuration(d, time.Second); err != nil {
+			fail(path, "%v", err)
+		}
+	}
+	for path, d := range map[string]Duration{
+		"healthCheck.interval":        c.HealthCheck.Interval,
+		"healthCheck.idleInterval":    c.HealthCheck.IdleInterval,
+		"healthCheck.maxBackoff":      c.HealthCheck.MaxBackoff,
+		"healthCheck.chainIDInterval": c.HealthCheck.ChainIDInterval,
+	} {
+		if err := checkDuration(d, time.Minute); err != nil {
+			fail(path, "%v", err)
+		}
+	}
+	if c.HealthCheck.Concurrency < 0 {
+		fail("healthCheck.concurrency", "should not be negative")
+	}
+	if c.HealthCheck.MaxLagBlocks != nil && *c.HealthCheck.MaxLagBlocks < 0 {
+		fail("healthCheck.maxLagBlocks", "should not be negative")
+	}
+	if c.HealthCheck.MaxLagSeconds != nil && *c.HealthCheck.MaxLagSeconds < 0 {
+		fail("healthCheck.maxLagSeconds", "should not be negative")
+	}
+	if c.Replica < 0 {
+		fail("replica", "should not be negative")
+	}
+
+	// Map iteration is random, keep the errors in a stable order
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+func checkURL(rawURL string, schemes ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid url %q", rawURL)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid url %q, the scheme should be %s", rawURL, strings.Join(schemes, " or "))
+}
+
+// checkDuration checks an optional duration is positive & a whole number of units, as the flags it sets are in units
+func checkDuration(d Duration, unit time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+	if d < 0 || time.Duration(d)%unit != 0 {
+		unitName := "seconds"
+		if unit == time.Minute {
+			unitName = "minutes"
+		}
+		return fmt.Errorf("should be a positive whole number of %s, got %s", unitName, time.Duration(d))
+	}
+	return nil
+}
+
+// setting is a flag set by the config file, unless the flag or its env variable is set
+type setting struct {
+	flag  string
+	env   string
+	value string
+}
+
+// settings returns the flags set by the config file
+func (c *Config) settings() ([]setting, error) {
+	var settings []setting
+	add := func(flag string, env string, value string, set bool) {
+		if set {
+			settings = append(settings, setting{flag: flag, env: env, value: value})
+		}
+	}
+	addJSON := func(flag string, env string, v any, set bool) error {
+		if !set {
+			return nil
+		}
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", flag, err)
+		}
+		add(flag, env, string(bs), true)
+		return nil
+	}
+	addList := func(flag string, env string, values []string) {
+		add(flag, env, strings.Join(values, ","), len(values) > 0)
+	}
+	minutes := func(d Duration) string { return strconv.Itoa(int(time.Duration(d) / time.Minute)) }
+	seconds := func(d Duration) string { return strconv.Itoa(int(time.Duration(d) / time.Second)) }
+
+	add("port", "GATEWAY_PORT", c.Server.Port, c.Server.Port != "")
+	add("metrics", "METRICS", "true", c.Server.Metrics)
+	add("metricsPort", "METRICS_PORT", c.Server.MetricsPort, c.Server.MetricsPort != "")
+	add("dashboard", "DASHBOARD", "true", c.Server.Dashboard)
+	add("dashboardPort", "DASHBOARD_PORT", c.Server.DashboardPort, c.Server.DashboardPort != "")
+	add("pprof", "", "true", c.Server.Pprof)
+	add("adminToken", "ADMIN_TOKEN", c.Server.AdminToken, c.Server.AdminToken != "")
+	readyChains := make([]string, 0, len(c.Server.Readiness.Chains))
+	for _, chainID := range c.Server.Readiness.Chains {
+		readyChains = append(readyChains, strconv.FormatInt(chainID, 10))
+	}
+	addList("readyChains", "READY_CHAINS", readyChains)
+	add("readyMinUpstreams", "READY_MIN_UPSTREAMS", strconv.Itoa(c.Server.Readiness.MinUpstreams), c.Server.Readiness.MinUpstreams != 0)
+	add("tlsCert", "TLS_CERT", c.Server.TLS.Cert, c.Server.TLS.Cert != "")
+	add("tlsKey", "TLS_KEY", c.Server.TLS.Key, c.Server.TLS.Key != "")
+	add("tlsClientCA", "TLS_CLIENT_CA", c.Server.TLS.ClientCA, c.Server.TLS.ClientCA != "")
+	add("requireClientCert", "REQUIRE_CLIENT_CERT", "true", c.Server.TLS.RequireClientCert)
+	clientCertKeys := make([]string, 0, len(c.Server.TLS.ClientCertKeys))
+	for name, key := range c.Server.TLS.ClientCertKeys {
+		clientCertKeys = append(clientCertKeys, name+"="+key)
+	}
+	sort.Strings(clientCertKeys)
+	addList("clientCertKeys", "CLIENT_CERT_KEYS", clientCertKeys)
+	addList("acmeDomains", "ACME_DOMAINS", c.Server.TLS.ACME.Domains)
+	add("acmeEmail", "ACME_EMAIL", c.Server.TLS.ACME.Email, c.Server.TLS.ACME.Email != "")
+	add("acmeCacheDir", "ACME_CACHE_DIR", c.Server.TLS.ACME.CacheDir, c.Server.TLS.ACME.CacheDir != "")
+	add("acmeDirectoryURL", "ACME_DIRECTORY_URL", c.Server.TLS.ACME.DirectoryURL, c.Server.TLS.ACME.DirectoryURL != "")
+	add("h2c", "H2C", "true", c.Server.H2C)
+	if c.Log.Level != nil {
+		add("logLevel", "", strconv.Itoa(*c.Log.Level), true)
+	}
+	add("logCaller", "", "true", c.Log.Caller)
+
+	if c.Registry.Snapshot != nil {
+		add("chainSnapshot", "CHAIN_SNAPSHOT", *c.Registry.Snapshot, true)
+	}
+	add("offline", "OFFLINE", "true", c.Registry.Offline)
+	add("registryFile", "REGISTRY_FILE", c.Registry.File, c.Registry.File != "")
+	add("registryURL", "REGISTRY_URL", c.Registry.URL, c.Registry.URL != "")
+	add("allowFlaggedChains", "ALLOW_FLAGGED_CHAINS", "true", c.Registry.AllowFlaggedChains)
+	add("privacyPolicy", "PRIVACY_POLICY", c.Registry.PrivacyPolicy, c.Registry.PrivacyPolicy != "")
+	aliases := make([]string, 0, len(c.Registry.Aliases))
+	for name, chainID := range c.Registry.Aliases {
+		aliases = append(aliases, fmt.Sprintf("%s=%d", name, chainID))
+	}
+	sort.Strings(aliases)
+	addList("chainAliases", "CHAIN_ALIASES", aliases)
+	secrets := make([]string, 0, len(c.Registry.Secrets))
+	for name, value := range c.Registry.Secrets {
+		secrets = append(secrets, name+"="+value)
+	}
+	sort.Strings(secrets)
+	addList("rpcSecrets", "RPC_SECRETS", secrets)
+	if err := addJSON("staticChains", "STATIC_CHAINS", c.Registry.StaticChains, len(c.Registry.StaticChains) > 0); err != nil {
+		return nil, err
+	}
+
+	add("cache_ttl", "", minutes(c.Cache.TTL), c.Cache.TTL != 0)
+	addList("cacheableMethods", "", c.Cache.Methods)
+	addList("cacheStaleMethods", "", c.Cache.Stale.Methods)
+	rules := make([]CacheRule, 0, len(c.Cache.Rules))
+	for _, rule := range c.Cache.Rules {
+		rules = append(rules, rule.rule())
+	}
+	if err := addJSON("cacheRules", "CACHE_RULES", rules, len(rules) > 0); err != nil {
+		return nil, err
+	}
+	add("negativeCacheTTL", "", seconds(c.Cache.Negative.TTL), c.Cache.Negative.TTL != 0)
+	addList("negativeCacheMethods", "", c.Cache.Negative.Methods)
+	add("cacheStaleWhileRevalidate", "", seconds(c.Cache.Stale.WhileRevalidate), c.Cache.Stale.WhileRevalidate != 0)
+	add("cacheStaleIfError", "", seconds(c.Cache.Stale.IfError), c.Cache.Stale.IfError != 0)
+	if c.Compression.Enabled != nil {
+		add("compression", "", strconv.FormatBool(*c.Compression.Enabled), true)
+	}
+	add("compressMinSize", "", strconv.Itoa(c.Compression.MinSize), c.Compression.MinSize != 0)
+	if c.Compression.Upstream != nil {
+		add("upstreamCompression", "", strconv.FormatBool(*c.Compression.Upstream), true)
+	}
+	if c.Coalescing.Enabled != nil {
+		add("coalescing", "", strconv.FormatBool(*c.Coalescing.Enabled), true)
+	}
+	addList("uncoalescedMethods", "", c.Coalescing.ExcludeMethods)
+
+	add("enableRateLimit", "ENABLE_RATE_LIMIT", "true", c.RateLimit.Enabled)
+	if c.RateLimit.WithoutAuth != nil {
+		add("rateLimitWithoutAuth", "", strconv.Itoa(*c.RateLimit.WithoutAuth), true)
+	}
+	if c.RateLimit.WithAuth != nil {
+		add("rateLimitWithAuth", "", strconv.Itoa(*c.RateLimit.WithAuth), true)
+	}
+	addList("apiKeys", "API_KEYS", c.RateLimit.Keys)
+	addList("allowedMethods", "ALLOWED_METHODS", c.Methods.Allow)
+	addList("deniedMethods", "DENIED_METHODS", c.Methods.Deny)
+
+	add("rpcTimeout", "", seconds(c.Timeouts.RPC), c.Timeouts.RPC != 0)
+	add("shutdownTimeout", "", seconds(c.Timeouts.Shutdown), c.Timeouts.Shutdown != 0)
+	add("shutdownDelay", "", seconds(c.Timeouts.ShutdownDelay), c.Timeouts.ShutdownDelay != 0)
+	add("rpcHealthCheckInterval", "", minutes(c.HealthCheck.Interval), c.HealthCheck.Interval != 0)
+	add("rpcHealthCheckIdleInterval", "", minutes(c.HealthCheck.IdleInterval), c.HealthCheck.IdleInterval != 0)
+	add("rpcHealthCheckMaxBackoff", "", minutes(c.HealthCheck.MaxBackoff), c.HealthCheck.MaxBackoff != 0)
+	add("chainIDCheckInterval", "", minutes(c.HealthCheck.ChainIDInterval), c.HealthCheck.ChainIDInterval != 0)
+	add("healthCheckConcurrency", "", strconv.Itoa(c.HealthCheck.Concurrency), c.HealthCheck.Concurrency != 0)
+	if c.HealthCheck.MaxLagBlocks != nil {
+		add("maxLagBlocks", "", strconv.FormatInt(*c.HealthCheck.MaxLagBlocks, 10), true)
+	}
+	if c.HealthCheck.MaxLagSeconds != nil {
+		add("maxLagSeconds", "", strconv.FormatInt(*c.HealthCheck.MaxLagSeconds, 10), true)
+	}
+	add("replica", "", strconv.Itoa(c.Replica), c.Replica != 0)
+	return settings, nil
+}
+
+// apply sets the flags from the config file, unless the flag or its env variable is set, which take precedence.
+// The reloadable flags are resolved into Policies instead.
+func (c *Config) apply() error {
+	settings, err := c.settings()
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if _, ok := reloadableFlags[s.flag]; ok {
+			continue
+		}
+		if isFlagSet(s.flag) || (s.env != "" && os.Getenv(s.env) != "") {
+			continue
+		}
+		if err := flag.Set(s.flag, s.value); err != nil {
+			return fmt.Errorf("%s: %w", s.flag, err)
+		}
+	}
+	return nil
+}
+
+// applyChains fills the upstreams & policies of the chains not set by the flags or env variables
+func (c *Config) applyChains(p *Policies) {
+	for _, chain := range c.Chains {
+		if _, ok := p.AdditionalRPCs[chain.ChainID]; !ok && len(chain.Upstreams) > 0 {
+			upstreams := make(map[string]Upstream)
+			for _, u := range chain.Upstreams {
+				p.AdditionalRPCs[chain.ChainID] = append(p.AdditionalRPCs[chain.ChainID], u.URL)
+				upstreams[u.URL] = Upstream{URL: u.URL, Weight: u.Weight, Tier: u.Tier, Tracking: u.Tracking}
+			}
+			p.Upstreams[chain.ChainID] = upstreams
+		}
+		if _, ok := p.FallbackRPCs[chain.ChainID]; !ok && len(chain.Fallbacks) > 0 {
+			p.FallbackRPCs[chain.ChainID] = chain.Fallbacks
+		}
+		if _, ok := p.ChainPolicies[chain.ChainID]; !ok {
+			p.ChainPolicies[chain.ChainID] = &ChainPolicy{
+				ChainID:             chain.ChainID,
+				MaxLagBlocks:        chain.MaxLagBlocks,
+				MaxLagSeconds:       chain.MaxLagSeconds,
+				HealthCheckInterval: int64(time.Duration(chain.HealthCheckInterval) / time.Second),
+				NewHeadsURL:         chain.NewHeadsURL,
+				RegistryTier:        chain.RegistryTier,
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package flags
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	config, err := LoadConfig(filepath.Join("..", "config.example.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Chains) != 2 || config.Chains[0].Upstreams[0].Weight != 2 || config.Chains[0].RegistryTier != 1 {
+		t.Fatalf("unexpected chains %+v", config.Chains)
+	}
+	if _, err := config.settings(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errs    []string
+	}{
+		{"unknown setting", "server:\n  prot: 8080\n", []string{"field prot not found"}},
+		{"invalid duration", "cache:\n  ttl: ten\n", []string{"line 2: invalid duration"}},
+		{"invalid settings", `
+server:
+  port: "99999"
+chains:
+  - chainID: 1
+    upstreams:
+      - url: eth.llamarpc.com
+      - url: https://rpc.example.com
+        weight: -1
+  - chainID: 1
+    newHeadsURL: https://bsc-rpc.publicnode.com
+cache:
+  ttl: 30s
+  rules:
+    - method: eth_getCode
+      blockParam: latest
+methods:
+  allow: [eth_call]
+  deny: [eth_call]
+`, []string{
+			`server.port: invalid port "99999"`,
+			`chains[0].upstreams[0].url: invalid url "eth.llamarpc.com"`,
+			"chains[0].upstreams[1].weight: should not be negative",
+			"chains[1].chainID: duplicate chain 1",
+			"chains[1].newHeadsURL",
+			"cache.ttl: should be a positive whole number of minutes",
+			"cache.rules[0]: eth_getCode: blockParam should be number, hash or fixed",
+			"methods.allow[0]: eth_call is also denied",
+		}},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(writeConfig(t, tt.content))
+		if err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+		for _, want := range tt.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q doesn't contain %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestGetUpstream(t *testing.T) {
+	defer SetPolicies(GetPolicies())
+	config := &Config{Chains: []ChainConfig{{
+		ChainID:      99993,
+		Upstreams:    []UpstreamConfig{{URL: "https://a.example.com", Weight: 3}, {URL: "https://b.example.com", Tier: 1}},
+		RegistryTier: 2,
+	}}}
+	p := newPolicies()
+	config.applyChains(p)
+	SetPolicies(p)
+
+	if u := GetUpstream(99993, "https://a.example.com"); u.Weight != 3 || u.Tier != 0 {
+		t.Errorf("unexpected upstream %+v", u)
+	}
+	if u := GetUpstream(99993, "https://b.example.com"); u.Weight != 1 || u.Tier != 1 {
+		t.Errorf("unexpected upstream %+v", u)
+	}
+	if u := GetUpstream(99993, "https://registry.example.com"); u.Weight != 1 || u.Tier != 2 {
+		t.Errorf("registry rpc should be in the registry tier, got %+v", u)
+	}
+}
+
+func TestGetChainPolicy(t *testing.T) {
+	defer SetPolicies(GetPolicies())
+	defer func(blocks, seconds int64) { *MaxLagBlocks, *MaxLagSeconds = blocks, seconds }(*MaxLagBlocks, *MaxLagSeconds)
+	*MaxLagBlocks, *MaxLagSeconds = 50, 120
+
+	config, err := LoadConfig(writeConfig(t, `
+chains:
+  - chainID: 99991
+    maxLagBlocks: 5
+    maxLagSeconds: 0
+  - chainID: 99990
+    healthCheckInterval: 10s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPolicies()
+	config.applyChains(p)
+	SetPolicies(p)
+
+	// 0 turns the global limit off for the chain, an unset limit is the global one
+	if blocks, seconds := GetChainPolicy(99991).LagLimits(); blocks != 5 || seconds != 0 {
+		t.Errorf("lag limits %d blocks %d seconds, want 5 & no limit", blocks, seconds)
+	}
+	for _, chainID := range []int64{99990, 99989} {
+		if blocks, seconds := GetChainPolicy(chainID).LagLimits(); blocks != 50 || seconds != 120 {
+			t.Errorf("chain %d: lag limits %d blocks %d seconds, want the global ones", chainID, blocks, seconds)
+		}
+	}
+	if interval := GetChainPolicy(99990).HealthCheckInterval; interval != 10 {
+		t.Errorf("health check interval %d, want 10", interval)
+	}
+}
+
+func TestReloadKeepsPoliciesOnError(t *testing.T) {
+	defer func(file string) { *configFile = file }(*configFile)
+	defer SetPolicies(GetPolicies())
+
+	*configFile = writeConfig(t, "methods:\n  deny: [eth_sendRawTransaction]\n")
+	if _, err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if MethodAllowed("eth_sendRawTransaction") {
+		t.Fatal("reloaded deny list not applied")
+	}
+
+	before := GetPolicies()
+	*configFile = writeConfig(t, "cache:\n  ttl: -1m\n")
+	if _, err := Reload(); err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+	if GetPolicies() != before {
+		t.Fatal("policies swapped by a failed reload")
+	}
+}
+
+func TestGetCacheRule(t *testing.T) {
+	defer func(file string) { *configFile = file }(*configFile)
+	defer SetPolicies(GetPolicies())
+
+	*configFile = writeConfig(t, `
+cache:
+  ttl: 5m
+  methods: [eth_getTransactionByHash]
+  rules:
+    - method: eth_getCode
+      ttl: 30s
+      blockParam: fixed
+    - chain: 1
+      method: eth_getCode
+      ttl: 1h
+      maxSize: 65536
+    - method: eth_getTransactionReceipt
+      negativeTTL: 2s
+`)
+	p, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, ok := p.GetCacheRule(1, "eth_getCode"); !ok || rule.TTL != 3600 || rule.MaxSize != 65536 || rule.BlockParam != "" {
+		t.Errorf("chain rule %+v", rule)
+	}
+	if rule, ok := p.GetCacheRule(56, "eth_getCode"); !ok || rule.TTL != 30 || rule.BlockParam != BlockParamFixed {
+		t.Errorf("rule of every chain %+v", rule)
+	}
+	if rule, ok := p.GetCacheRule(56, "eth_getTransactionReceipt"); !ok || rule.TTL != 300 || rule.NegativeTTL != 2 {
+		t.Errorf("rule without a ttl should get cache.ttl: %+v", rule)
+	}
+	if rule, ok := p.GetCacheRule(56, "eth_getTransactionByHash"); !ok || rule.TTL != 300 {
+		t.Errorf("cacheable method %+v", rule)
+	}
+	if _, ok := p.GetCacheRule(56, "eth_blockNumber"); ok {
+		t.Error("eth_blockNumber should not be cacheable")
+	}
+}
+
+func TestConfigPort(t *testing.T) {
+	old := *Port
+	t.Cleanup(func() { *Port = old })
+	config, err := LoadConfig(writeConfig(t, "server:\n  port: \"9000\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config file sets the port unless the env variable does
+	for _, tt := range []struct{ env, want string }{{"", "9000"}, {"7000", "7000"}} {
+		t.Setenv("GATEWAY_PORT", tt.env)
+		*Port = ""
+		if err := config.apply(); err != nil {
+			t.Fatal(err)
+		}
+		resolvePort()
+		if *Port != tt.want {
+			t.Errorf("GATEWAY_PORT=%q: port = %s, want %s", tt.env, *Port, tt.want)
+		}
+	}
+
+	t.Setenv("GATEWAY_PORT", "")
+	*Port = ""
+	resolvePort()
+	if *Port != defaultPort {
+		t.Errorf("port = %s, want the default %s", *Port, defaultPort)
+	}
+}
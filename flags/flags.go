@@ -3,9 +3,13 @@ package flags
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/joho/godotenv"
+	"io"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -24,31 +28,126 @@ func (r RPCGroup) ToRPCMap() map[int64][]string {
 	return rpcMap
 }
 
+// ChainPolicy holds per chain overrides of the upstream selection & health check settings, unset fields fall back to the
+// global flags. A lag limit of 0 turns the limit off for the chain, a health check interval of 0 is the global one.
+type ChainPolicy struct {
+	ChainID             int64  `json:"chainID"`
+	MaxLagBlocks        *int64 `json:"maxLagBlocks,omitempty"`        // Exclude rpcs more than this many blocks behind the chain head, 0: no limit
+	MaxLagSeconds       *int64 `json:"maxLagSeconds,omitempty"`       // Exclude rpcs whose latest block is older than the chain head's by more than this many seconds, 0: no limit
+	HealthCheckInterval int64  `json:"healthCheckInterval,omitempty"` // Health check interval in seconds, useful for chains with fast block times
+	NewHeadsURL         string `json:"newHeadsURL,omitempty"`         // Websocket rpc to follow newHeads on for faster head tracking
+	RegistryTier        int    `json:"registryTier,omitempty"`        // Tier of the chain registry rpcs, raise it to only use them when the configured upstreams fail
+}
+
+// CacheRule is the cache policy of a method on a chain, or on every chain without a chain ID. A rule makes its method
+// cacheable, the chain's rule takes precedence over the rule of every chain.
+type CacheRule struct {
+	ChainID     int64  `json:"chainID,omitempty"`
+	Method      string `json:"method"`
+	TTL         int64  `json:"ttl,omitempty"`         // Seconds to cache the responses, 0: cache_ttl
+	BlockParam  string `json:"blockParam,omitempty"`  // Only cache when the block param is a "number", a "hash" or either ("fixed"), not a tag like latest
+	MaxSize     int    `json:"maxSize,omitempty"`     // Larger responses in bytes aren't cached, 0: no limit
+	NegativeTTL int64  `json:"negativeTTL,omitempty"` // Seconds to cache empty & null results, 0: not cached
+}
+
+// Block param conditions of the cache rules
+const (
+	BlockParamNumber = "number"
+	BlockParamHash   = "hash"
+	BlockParamFixed  = "fixed"
+)
+
+// Upstream is the selection weight & tier of an rpc, rpcs of the lowest tier with healthy ones are selected first,
+// by their relative weight
+type Upstream struct {
+	URL      string
+	Weight   int
+	Tier     int
+	Tracking string // none, limited or yes, empty: the chain registry's or none for an upstream unknown to it
+}
+
 var (
 	// Flags that can also be load in .env file
-	Port                 = flag.String("port", "8080", "RPC gateway port, e.g. 8080")
+	Port                 = flag.String("port", "", "RPC gateway port (default "+defaultPort+")")
 	Metrics              = flag.Bool("metrics", false, "Enable prometheus metrics")
 	MetricsPort          = flag.String("metricsPort", "", "Metrics server port")
+	Dashboard            = flag.Bool("dashboard", false, "Enable the status dashboard")
+	DashboardPort        = flag.String("dashboardPort", "", "Dashboard server port")
 	rpcs                 = flag.String("rpcs", "", "Additional rpcs besides the public ones, e.g. [{\"chainID\":1,\"rpc\":[\"https://eth.llamarpc.com\",\"https://rpc.builder0x69.io\"]}]")
 	fallbacks            = flag.String("fallback", "", "Fallback rpcs, e.g. [{\"chainID\":1,\"rpc\":[\"https://eth.llamarpc.com\",\"https://rpc.builder0x69.io\"]}]")
-	EnableRateLimit      = flag.Bool("enableRateLimit", false, "Enable rate limit")
-	RateLimitWithoutAuth = flag.Int("rateLimitWithoutAuth", 100, "Rate limit per second without auth")
-	RateLimitWithAuth    = flag.Int("rateLimitWithAuth", 0, "Rate limit per second with auth (0: no limit)")
+	enableRateLimit      = flag.Bool("enableRateLimit", false, "Enable rate limit")
+	rateLimitWithoutAuth = flag.Int("rateLimitWithoutAuth", 100, "Rate limit per second without auth")
+	rateLimitWithAuth    = flag.Int("rateLimitWithAuth", 0, "Rate limit per second with auth (0: no limit)")
+	PrivacyPolicy        = flag.String("privacyPolicy", "any", "Most tracking an rpc may do to be selected: none, limited, no-yes (exclude rpcs known to track) or any, clients can only choose a stricter policy")
+	ChainSnapshot        = flag.String("chainSnapshot", "./data/chains.json", "Chain registry snapshot, saved after every successful refresh and loaded when the remote sources are unreachable (empty: disabled)")
+	RegistryFile         = flag.String("registryFile", "", "Additional chain registry in a local json file, in the format of https://chainid.network/chains.json")
+	RegistryURL          = flag.String("registryURL", "", "Additional chain registry served over http, in the format of https://chainid.network/chains.json")
+	staticChains         = flag.String("staticChains", "", "Chains overriding the chain registry, e.g. [{\"chainId\":1337,\"name\":\"Devnet\",\"shortName\":\"dev\",\"rpc\":[\"http://localhost:8545\"]}]")
+	chainAliases         = flag.String("chainAliases", "ethereum=1,bsc=56,polygon=137,matic=137,arbitrum=42161,optimism=10,base=8453,avalanche=43114,avax=43114", "Chain name aliases for routes like /chain/bsc or /bsc, besides the short names of the chain registry")
+	rpcSecrets           = flag.String("rpcSecrets", "", "Secrets to fill the placeholders of registry rpc urls, e.g. INFURA_API_KEY=xxx,ALCHEMY_API_KEY=yyy, urls with unknown placeholders are dropped")
+	AllowFlaggedChains   = flag.Bool("allowFlaggedChains", false, "Serve chains that are deprecated or red flagged (e.g. reusedChainId) in the chain registry")
+	Offline              = flag.Bool("offline", false, "Load the chain registry from the chain snapshot only, without contacting the remote sources")
+	configFile           = flag.String("config", "", "Config file in yaml, see config.example.yaml, the flags & env variables override it")
+	apiKeys              = flag.String("apiKeys", "", "API keys for the rate limit with auth, e.g. key1,key2 (empty: generated at startup)")
+	allowedMethods       = flag.String("allowedMethods", "", "Only serve these methods, e.g. eth_call,eth_blockNumber (empty: all methods not denied)")
+	deniedMethods        = flag.String("deniedMethods", "", "Methods to reject, e.g. eth_sendRawTransaction")
+	AdminToken           = flag.String("adminToken", "", "Bearer token of the admin api, e.g. /admin/reload (empty: admin api disabled)")
+	readyChains          = flag.String("readyChains", "", "Chain IDs that need healthy upstreams for /readyz to pass, e.g. 1,56")
+	ReadyMinUpstreams    = flag.Int("readyMinUpstreams", 1, "Upstreams that must be OK and within the lag threshold for each of the readyChains")
+	TLSCert              = flag.String("tlsCert", "", "TLS certificate file, the gateway serves https when set, the files are reloaded once they change")
+	TLSKey               = flag.String("tlsKey", "", "TLS private key file")
+	TLSClientCA          = flag.String("tlsClientCA", "", "CA file to verify client certificates, enables mTLS")
+	RequireClientCert    = flag.Bool("requireClientCert", false, "Reject clients without a certificate verified by tlsClientCA")
+	clientCertKeys       = flag.String("clientCertKeys", "", "API keys of the client certificates by common name or SAN, e.g. alice=key1,bob.example.com=key2")
+	acmeDomains          = flag.String("acmeDomains", "", "Domains to get certificates for from an ACME CA, e.g. rpc.example.com, the gateway must be reachable on port 443 for the tls-alpn-01 challenge")
+	ACMEEmail            = flag.String("acmeEmail", "", "Contact email of the ACME account")
+	ACMECacheDir         = flag.String("acmeCacheDir", "./data/acme", "Directory to keep the ACME account & certificates")
+	ACMEDirectoryURL     = flag.String("acmeDirectoryURL", "", "ACME directory url (empty: Let's Encrypt)")
+	H2C                  = flag.Bool("h2c", false, "Serve HTTP/2 without TLS (prior knowledge) besides HTTP/1.1, HTTP/2 is always served over TLS")
 
 	// Flags that do not exist in .env.example file
-	Pprof                  = flag.Bool("pprof", false, "Enable pprof")
-	Replica                = flag.Int("replica", 1, "replica rpcs to send request")
-	cacheableMethods       = flag.String("cacheableMethods", "eth_getTransactionByHash,eth_getBlockByNumber,eth_getTransactionReceipt,eth_getBlockReceipts,eth_getTransactionByBlockHashAndIndex,eth_getTransactionByBlockNumberAndIndex,eth_getBlockByHash,eth_getBlockTransactionCountByHash,eth_getBlockTransactionCountByNumber", "Cacheable methods")
-	CacheTTL               = flag.Uint("cache_ttl", 10, "Cache TTL in minutes")
-	LogLevel               = flag.Int("logLevel", 1, "Log level, -1: trace, 0: debug, 1: info, 2: warn, 3: error, 4: fatal, 5: panic")
-	LogCaller              = flag.Bool("logCaller", false, "Log caller")
-	RPCTimeout             = flag.Int("rpcTimeout", 20, "RPC timeout in seconds")
-	RPCHealthCheckInterval = flag.Int("rpcHealthCheckInterval", 1, "RPC health check interval in minutes")
-
-	// Transformed flags for easier use
-	AdditionalRPCs   = make(map[int64][]string)
-	FallbackRPCs     = make(map[int64][]string)
-	CacheableMethods = make(map[string]bool)
+	Pprof                      = flag.Bool("pprof", false, "Enable pprof")
+	replica                    = flag.Int("replica", 1, "replica rpcs to send request")
+	cacheableMethods           = flag.String("cacheableMethods", "eth_getTransactionByHash,eth_getBlockByNumber,eth_getTransactionReceipt,eth_getBlockReceipts,eth_getTransactionByBlockHashAndIndex,eth_getTransactionByBlockNumberAndIndex,eth_getBlockByHash,eth_getBlockTransactionCountByHash,eth_getBlockTransactionCountByNumber", "Cacheable methods")
+	cacheTTL                   = flag.Uint("cache_ttl", 10, "Cache TTL in minutes")
+	cacheRules                 = flag.String("cacheRules", `[{"method":"eth_chainId","ttl":3600},{"method":"net_version","ttl":3600},{"method":"eth_getCode","blockParam":"fixed"},{"method":"eth_getBlockByNumber","blockParam":"number"},{"method":"eth_getBlockTransactionCountByNumber","blockParam":"number"},{"method":"eth_getTransactionByBlockNumberAndIndex","blockParam":"number"},{"method":"eth_getBlockReceipts","blockParam":"fixed"}]`, "Cache rules per method & chain, e.g. [{\"chainID\":1,\"method\":\"eth_getCode\",\"ttl\":600,\"blockParam\":\"fixed\",\"maxSize\":65536,\"negativeTTL\":2}]")
+	negativeCacheTTL           = flag.Uint("negativeCacheTTL", 0, "Seconds to cache the empty & null results of the negativeCacheMethods, dropped early once the chain head moves on (0: disabled)")
+	negativeCacheMethods       = flag.String("negativeCacheMethods", "eth_getTransactionReceipt,eth_getTransactionByHash,eth_getBlockByNumber,eth_getBlockByHash,eth_getBlockReceipts", "Lookups whose not found results are cached for negativeCacheTTL, the cache rules may set their own negativeTTL")
+	cacheStaleMethods          = flag.String("cacheStaleMethods", "", "Cacheable methods whose expired responses may be served within the stale windows, e.g. eth_getBlockByHash")
+	cacheStaleWhileRevalidate  = flag.Uint("cacheStaleWhileRevalidate", 0, "Seconds after the TTL to serve expired responses at once while they're refreshed in the background")
+	cacheStaleIfError          = flag.Uint("cacheStaleIfError", 0, "Seconds after the TTL to serve expired responses when all upstreams fail")
+	LogLevel                   = flag.Int("logLevel", 1, "Log level, -1: trace, 0: debug, 1: info, 2: warn, 3: error, 4: fatal, 5: panic")
+	LogCaller                  = flag.Bool("logCaller", false, "Log caller")
+	RPCTimeout                 = flag.Int("rpcTimeout", 20, "RPC timeout in seconds")
+	ShutdownTimeout            = flag.Int("shutdownTimeout", 30, "Seconds to drain the in-flight requests on shutdown")
+	ShutdownDelay              = flag.Int("shutdownDelay", 0, "Seconds the readiness probe fails before the gateway stops accepting connections on shutdown, so the load balancers stop routing to it first")
+	Compression                = flag.Bool("compression", true, "Compress responses with gzip, brotli or zstd as accepted by the client, and accept compressed request bodies")
+	CompressMinSize            = flag.Int("compressMinSize", 1024, "Minimum response size in bytes to compress")
+	UpstreamCompression        = flag.Bool("upstreamCompression", true, "Ask the upstreams for compressed responses, per upstream until one can't be decoded")
+	Coalescing                 = flag.Bool("coalescing", true, "Serve identical concurrent requests by one upstream call")
+	uncoalescedMethods         = flag.String("uncoalescedMethods", "eth_sendRawTransaction,eth_sendTransaction,eth_newFilter,eth_newBlockFilter,eth_newPendingTransactionFilter,eth_getFilterChanges,eth_uninstallFilter", "Methods never coalesced, e.g. the ones with side effects or per-call state")
+	RPCHealthCheckInterval     = flag.Int("rpcHealthCheckInterval", 1, "RPC health check interval in minutes")
+	RPCHealthCheckIdleInterval = flag.Int("rpcHealthCheckIdleInterval", 5, "Health check interval in minutes for healthy rpcs of chains without traffic")
+	RPCHealthCheckMaxBackoff   = flag.Int("rpcHealthCheckMaxBackoff", 30, "Maximum health check backoff in minutes for failing rpcs")
+	HealthCheckConcurrency     = flag.Int("healthCheckConcurrency", 32, "Maximum number of concurrent health checks")
+	ChainIDCheckInterval       = flag.Int("chainIDCheckInterval", 60, "Interval in minutes to re-verify the chain ID reported by each rpc")
+	MaxLagBlocks               = flag.Int64("maxLagBlocks", 0, "Exclude rpcs more than this many blocks behind the chain head (0: no limit)")
+	MaxLagSeconds              = flag.Int64("maxLagSeconds", 120, "Exclude rpcs whose latest block is older than the chain head's by more than this many seconds (0: no limit)")
+	chainPolicies              = flag.String("chainPolicies", "", "Per chain lag thresholds & head tracking, e.g. [{\"chainID\":56,\"maxLagBlocks\":20,\"maxLagSeconds\":60,\"healthCheckInterval\":10,\"newHeadsURL\":\"wss://bsc-rpc.publicnode.com\"}]")
+
+	// Transformed flags for easier use, the reloadable ones are in Policies
+	StaticChains json.RawMessage
+	RPCSecrets   = make(map[string]string)
+	ChainAliases = make(map[string]int64)
+	ReadyChains  = make([]int64, 0)
+	// ClientCertKeys are the API keys of the client certificates by common name or SAN
+	ClientCertKeys = make(map[string]string)
+	ACMEDomains    = make([]string, 0)
+	// UncoalescedMethods are never coalesced with identical concurrent requests
+	UncoalescedMethods = make(map[string]bool)
+
+	// commandLine are the flags set on the command line, as opposed to by the config file
+	commandLine = make(map[string]bool)
 )
 
 func Init() {
@@ -59,21 +158,34 @@ func Init() {
 			// If the .env file does not exist, log a warning and continue
 			log.Println(".env file does not exist, skipping .env file loading.")
 		} else {
-			log.Fatalf("error loading .env file: " + err.Error())
+			log.Fatalf("error loading .env file: %v", err)
 		}
 	} else {
 		log.Println("Loading .env file")
 	}
 
 	flag.Parse()
-	// Check if required flags are provided
-	if *Port == "" {
-		*Port = os.Getenv("GATEWAY_PORT")
-		if *Port == "" {
-			log.Fatalf("port is required")
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+
+	// Load the config file, the flags & env variables below take precedence
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	var config *Config
+	if *configFile != "" {
+		config, err = LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("invalid config file %v", err)
+		}
+		if err := config.apply(); err != nil {
+			log.Fatalf("failed to apply config file: %v", err)
 		}
 	}
 
+	resolvePort()
+
 	// Parse metrics flag
 	if *Metrics == false {
 		*Metrics = strings.ToLower(os.Getenv("METRICS")) == "true"
@@ -88,57 +200,239 @@ func Init() {
 		}
 	}
 
-	// Parse replica flag
-	if *Replica <= 0 {
-		log.Fatalf("replica should be greater than 0")
+	// Parse dashboard flag
+	if *Dashboard == false {
+		*Dashboard = strings.ToLower(os.Getenv("DASHBOARD")) == "true"
 	}
 
-	var additionalRPCGroup RPCGroup
-	if *rpcs != "" {
-		err := json.Unmarshal([]byte(*rpcs), &additionalRPCGroup)
-		if err != nil {
-			log.Fatalf("failed to parse rpcs flag: %v", err)
-		}
-	} else {
-		rpcEnv := os.Getenv("RPCS")
-		if rpcEnv != "" {
-			err := json.Unmarshal([]byte(rpcEnv), &additionalRPCGroup)
-			if err != nil {
-				log.Fatalf("failed to parse RPCS env variable: %v", err)
+	if *Dashboard {
+		if *DashboardPort == "" {
+			*DashboardPort = os.Getenv("DASHBOARD_PORT")
+			if *DashboardPort == "" {
+				log.Fatalf("dashboardPort is required if dashboard is enabled")
 			}
 		}
 	}
-	for _, rpc := range additionalRPCGroup {
-		AdditionalRPCs[rpc.ChainID] = rpc.RPC
+
+	if os.Getenv("CHAIN_SNAPSHOT") != "" && !isFlagSet("chainSnapshot") {
+		*ChainSnapshot = os.Getenv("CHAIN_SNAPSHOT")
+	}
+	if os.Getenv("PRIVACY_POLICY") != "" && !isFlagSet("privacyPolicy") {
+		*PrivacyPolicy = os.Getenv("PRIVACY_POLICY")
+	}
+	switch *PrivacyPolicy {
+	case "none", "limited", "no-yes", "any":
+	default:
+		log.Fatalf("invalid privacyPolicy: %s, should be one of none, limited, no-yes, any", *PrivacyPolicy)
+	}
+
+	if *RegistryFile == "" {
+		*RegistryFile = os.Getenv("REGISTRY_FILE")
+	}
+	if *RegistryURL == "" {
+		*RegistryURL = os.Getenv("REGISTRY_URL")
+	}
+	if *staticChains == "" {
+		*staticChains = os.Getenv("STATIC_CHAINS")
+	}
+	if *staticChains != "" {
+		var chains []json.RawMessage
+		if err := json.Unmarshal([]byte(*staticChains), &chains); err != nil {
+			log.Fatalf("failed to parse staticChains flag: %v", err)
+		}
+		StaticChains = json.RawMessage(*staticChains)
+	}
+	if *rpcSecrets == "" {
+		*rpcSecrets = os.Getenv("RPC_SECRETS")
+	}
+	for _, secret := range strings.Split(*rpcSecrets, ",") {
+		if strings.TrimSpace(secret) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(secret, "=")
+		if !ok {
+			log.Fatalf("failed to parse rpcSecrets flag: %s should be NAME=value", name)
+		}
+		RPCSecrets[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if os.Getenv("CHAIN_ALIASES") != "" && !isFlagSet("chainAliases") {
+		*chainAliases = os.Getenv("CHAIN_ALIASES")
+	}
+	for _, alias := range strings.Split(*chainAliases, ",") {
+		if strings.TrimSpace(alias) == "" {
+			continue
+		}
+		name, id, ok := strings.Cut(alias, "=")
+		chainID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if !ok || err != nil {
+			log.Fatalf("failed to parse chainAliases flag: %s should be name=chainID", alias)
+		}
+		ChainAliases[strings.ToLower(strings.TrimSpace(name))] = chainID
 	}
 
-	var fallbackRPCGroup RPCGroup
-	if *fallbacks != "" {
-		err := json.Unmarshal([]byte(*rpcs), &fallbackRPCGroup)
+	if *AdminToken == "" {
+		*AdminToken = os.Getenv("ADMIN_TOKEN")
+	}
+	if *readyChains == "" {
+		*readyChains = os.Getenv("READY_CHAINS")
+	}
+	for _, id := range splitList(*readyChains) {
+		chainID, err := strconv.ParseInt(id, 10, 64)
 		if err != nil {
-			log.Fatalf("failed to parse rpcs flag: %v", err)
+			log.Fatalf("failed to parse readyChains flag: %s should be a chain ID", id)
 		}
-	} else {
-		rpcEnv := os.Getenv("FALLBACKS")
-		if rpcEnv != "" {
-			err := json.Unmarshal([]byte(rpcEnv), &fallbackRPCGroup)
-			if err != nil {
-				log.Fatalf("failed to parse FALLBACKS env variable: %v", err)
-			}
+		ReadyChains = append(ReadyChains, chainID)
+	}
+	if os.Getenv("READY_MIN_UPSTREAMS") != "" && !isFlagSet("readyMinUpstreams") {
+		n, err := strconv.Atoi(os.Getenv("READY_MIN_UPSTREAMS"))
+		if err != nil {
+			log.Fatalf("failed to parse READY_MIN_UPSTREAMS: %v", err)
 		}
+		*ReadyMinUpstreams = n
 	}
-	for _, rpc := range fallbackRPCGroup {
-		FallbackRPCs[rpc.ChainID] = rpc.RPC
+	if *ReadyMinUpstreams < 1 {
+		log.Fatalf("invalid readyMinUpstreams: should be at least 1")
 	}
 
-	if *EnableRateLimit == false {
-		*EnableRateLimit = strings.ToLower(os.Getenv("ENABLE_RATE_LIMIT")) == "true"
+	for _, method := range splitList(*uncoalescedMethods) {
+		UncoalescedMethods[method] = true
 	}
 
-	// Parse cacheable methods
-	*cacheableMethods = strings.ReplaceAll(*cacheableMethods, " ", "")
-	methods := strings.Split(*cacheableMethods, ",")
-	for _, method := range methods {
-		CacheableMethods[method] = true
+	// TLS
+	for name, value := range map[string]*string{
+		"TLS_CERT":           TLSCert,
+		"TLS_KEY":            TLSKey,
+		"TLS_CLIENT_CA":      TLSClientCA,
+		"CLIENT_CERT_KEYS":   clientCertKeys,
+		"ACME_DOMAINS":       acmeDomains,
+		"ACME_EMAIL":         ACMEEmail,
+		"ACME_DIRECTORY_URL": ACMEDirectoryURL,
+	} {
+		if *value == "" {
+			*value = os.Getenv(name)
+		}
 	}
+	if os.Getenv("ACME_CACHE_DIR") != "" && !isFlagSet("acmeCacheDir") {
+		*ACMECacheDir = os.Getenv("ACME_CACHE_DIR")
+	}
+	if *RequireClientCert == false {
+		*RequireClientCert = strings.ToLower(os.Getenv("REQUIRE_CLIENT_CERT")) == "true"
+	}
+	if *H2C == false {
+		*H2C = strings.ToLower(os.Getenv("H2C")) == "true"
+	}
+	ACMEDomains = splitList(*acmeDomains)
+	for _, entry := range splitList(*clientCertKeys) {
+		name, key, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" || strings.TrimSpace(key) == "" {
+			log.Fatalf("failed to parse clientCertKeys flag: %s should be name=apiKey", entry)
+		}
+		ClientCertKeys[strings.TrimSpace(name)] = strings.TrimSpace(key)
+	}
+	if (*TLSCert == "") != (*TLSKey == "") {
+		log.Fatalf("tlsCert and tlsKey are required together")
+	}
+	if *TLSCert != "" && len(ACMEDomains) > 0 {
+		log.Fatalf("tlsCert and acmeDomains are mutually exclusive")
+	}
+	if *TLSClientCA != "" && *TLSCert == "" && len(ACMEDomains) == 0 {
+		log.Fatalf("tlsClientCA requires tlsCert or acmeDomains")
+	}
+	if (*RequireClientCert || len(ClientCertKeys) > 0) && *TLSClientCA == "" {
+		log.Fatalf("requireClientCert and clientCertKeys require tlsClientCA")
+	}
+
+	if *AllowFlaggedChains == false {
+		*AllowFlaggedChains = strings.ToLower(os.Getenv("ALLOW_FLAGGED_CHAINS")) == "true"
+	}
+	if *Offline == false {
+		*Offline = strings.ToLower(os.Getenv("OFFLINE")) == "true"
+	}
+	if *Offline && *ChainSnapshot == "" {
+		log.Fatalf("chainSnapshot is required in offline mode")
+	}
+
+	// Resolve the reloadable settings
+	p, err := buildPolicies(config)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	SetPolicies(p)
+	loadedConfig = config
+}
+
+// splitList splits a comma separated list, skipping empty entries
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// secretPlaceholder matches the placeholders of rpc urls filled from the rpcSecrets, e.g. ${INFURA_API_KEY}
+var secretPlaceholder = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+// HasSecretPlaceholder reports whether the url has placeholders to fill from the rpcSecrets
+func HasSecretPlaceholder(url string) bool {
+	return secretPlaceholder.MatchString(url)
+}
+
+// FillSecrets returns the url with its placeholders filled from the secrets, false if one of them has no secret.
+// The filled url is only used to send requests, the url with the placeholders stays the identity of the rpc in the
+// metrics, logs & responses.
+func FillSecrets(url string, secrets map[string]string) (string, bool) {
+	ok := true
+	filled := secretPlaceholder.ReplaceAllStringFunc(url, func(placeholder string) string {
+		secret := secrets[secretPlaceholder.FindStringSubmatch(placeholder)[1]]
+		if secret == "" {
+			ok = false
+			return placeholder
+		}
+		return secret
+	})
+	return filled, ok
+}
+
+// secretFlags are masked by PrintConfig
+var secretFlags = map[string]bool{"rpcSecrets": true, "apiKeys": true, "adminToken": true, "clientCertKeys": true}
+
+// PrintConfig writes the effective value of every flag, after the config file, env variables & flags are merged
+func PrintConfig(w io.Writer) {
+	resolve, err := resolver(loadedConfig)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if _, ok := reloadableFlags[f.Name]; ok {
+			value = resolve(f.Name)
+		}
+		if secretFlags[f.Name] && value != "" {
+			value = "***"
+		}
+		fmt.Fprintf(w, "%s=%s\n", f.Name, value)
+	})
+}
+
+// defaultPort is the gateway port unless set by the flag, the env variable or the config file
+const defaultPort = "8080"
+
+// resolvePort falls back to the GATEWAY_PORT env variable and the default port, if neither the flag nor the config file
+// set the port. The config file doesn't set it if the env variable is set.
+func resolvePort() {
+	if *Port == "" {
+		*Port = os.Getenv("GATEWAY_PORT")
+	}
+	if *Port == "" {
+		*Port = defaultPort
+	}
+}
+
+// isFlagSet reports whether the flag was set on the command line
+func isFlagSet(name string) bool {
+	return commandLine[name]
 }
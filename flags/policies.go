@@ -0,0 +1,342 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies are the settings that can be reloaded at runtime: the upstreams, fallbacks & policies of the chains, the cache,
+// rate limits, api keys and method policies. A Policies is never modified once in use, Reload swaps it as a whole.
+type Policies struct {
+	AdditionalRPCs       map[int64][]string
+	FallbackRPCs         map[int64][]string
+	Upstreams            map[int64]map[string]Upstream
+	ChainPolicies        map[int64]*ChainPolicy
+	CacheableMethods     map[string]bool
+	CacheTTL             time.Duration
+	CacheRules           map[int64]map[string]CacheRule // by chain ID, 0: every chain, and method
+	NegativeCacheTTL     time.Duration
+	NegativeMethods      map[string]bool // methods whose not found results are cached for NegativeCacheTTL
+	StaleMethods         map[string]bool // methods opted in to the stale windows
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	Replica              int
+	EnableRateLimit      bool
+	RateLimitWithAuth    int // per second, 0: no limit
+	RateLimitWithoutAuth int // per second
+	APIKeys              map[string]bool
+	AllowedMethods       map[string]bool
+	DeniedMethods        map[string]bool
+}
+
+func newPolicies() *Policies {
+	return &Policies{
+		AdditionalRPCs:   make(map[int64][]string),
+		FallbackRPCs:     make(map[int64][]string),
+		Upstreams:        make(map[int64]map[string]Upstream),
+		ChainPolicies:    make(map[int64]*ChainPolicy),
+		CacheableMethods: make(map[string]bool),
+		CacheRules:       make(map[int64]map[string]CacheRule),
+		NegativeMethods:  make(map[string]bool),
+		StaleMethods:     make(map[string]bool),
+		APIKeys:          make(map[string]bool),
+		AllowedMethods:   make(map[string]bool),
+		DeniedMethods:    make(map[string]bool),
+	}
+}
+
+var (
+	policies    atomic.Pointer[Policies]
+	reloadMutex sync.Mutex
+	// loadedConfig is the config file the policies in use were built from
+	loadedConfig *Config
+)
+
+func init() {
+	policies.Store(newPolicies())
+}
+
+// GetPolicies returns the policies in use, the result must not be modified
+func GetPolicies() *Policies {
+	return policies.Load()
+}
+
+// SetPolicies swaps the policies in use
+func SetPolicies(p *Policies) {
+	policies.Store(p)
+}
+
+// Reload re-reads the config file and swaps the policies, the flags & env variables keep their precedence.
+// On error the policies in use are kept.
+func Reload() (*Policies, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	var config *Config
+	if *configFile != "" {
+		var err error
+		if config, err = LoadConfig(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	p, err := buildPolicies(config)
+	if err != nil {
+		return nil, err
+	}
+	policies.Store(p)
+	loadedConfig = config
+	return p, nil
+}
+
+// reloadableFlags are the flags resolved into Policies, with their env variable
+var reloadableFlags = map[string]string{
+	"rpcs":                      "RPCS",
+	"fallback":                  "FALLBACKS",
+	"chainPolicies":             "CHAIN_POLICIES",
+	"cacheableMethods":          "",
+	"cache_ttl":                 "",
+	"cacheRules":                "CACHE_RULES",
+	"negativeCacheTTL":          "",
+	"negativeCacheMethods":      "",
+	"cacheStaleMethods":         "",
+	"cacheStaleWhileRevalidate": "",
+	"cacheStaleIfError":         "",
+	"replica":                   "",
+	"enableRateLimit":           "ENABLE_RATE_LIMIT",
+	"rateLimitWithAuth":         "",
+	"rateLimitWithoutAuth":      "",
+	"apiKeys":                   "API_KEYS",
+	"allowedMethods":            "ALLOWED_METHODS",
+	"deniedMethods":             "DENIED_METHODS",
+}
+
+// resolver returns the value of a reloadable flag from the command line, its env variable, the config file or its
+// default, in that order
+func resolver(config *Config) (func(name string) string, error) {
+	fileSettings := make(map[string]string)
+	if config != nil {
+		settings, err := config.settings()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			fileSettings[s.flag] = s.value
+		}
+	}
+	return func(name string) string {
+		if commandLine[name] {
+			return flag.Lookup(name).Value.String()
+		}
+		if env := reloadableFlags[name]; env != "" && os.Getenv(env) != "" {
+			return os.Getenv(env)
+		}
+		if v, ok := fileSettings[name]; ok {
+			return v
+		}
+		return flag.Lookup(name).DefValue
+	}, nil
+}
+
+// buildPolicies resolves the reloadable settings
+func buildPolicies(config *Config) (*Policies, error) {
+	value, err := resolver(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPolicies()
+	var errs []error
+	parseInt := func(name string, min int) int {
+		n, err := strconv.Atoi(value(name))
+		if err != nil || n < min {
+			errs = append(errs, fmt.Errorf("invalid %s: should be a number not less than %d", name, min))
+		}
+		return n
+	}
+	parseBool := func(name string) bool {
+		return strings.ToLower(value(name)) == "true"
+	}
+	parseRPCGroup := func(name string) map[int64][]string {
+		rpcMap := make(map[int64][]string)
+		if v := value(name); v != "" {
+			var group RPCGroup
+			if err := json.Unmarshal([]byte(v), &group); err != nil {
+				errs = append(errs, fmt.Errorf("failed to parse %s: %v", name, err))
+			}
+			rpcMap = group.ToRPCMap()
+		}
+		return rpcMap
+	}
+
+	p.AdditionalRPCs = parseRPCGroup("rpcs")
+	p.FallbackRPCs = parseRPCGroup("fallback")
+	if v := value("chainPolicies"); v != "" {
+		var chainPolicies []*ChainPolicy
+		if err := json.Unmarshal([]byte(v), &chainPolicies); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse chainPolicies: %v", err))
+		}
+		for _, policy := range chainPolicies {
+			p.ChainPolicies[policy.ChainID] = policy
+		}
+	}
+
+	for _, method := range splitList(value("cacheableMethods")) {
+		p.CacheableMethods[method] = true
+	}
+	p.CacheTTL = time.Duration(parseInt("cache_ttl", 0)) * time.Minute
+	if v := value("cacheRules"); v != "" {
+		var rules []CacheRule
+		if err := json.Unmarshal([]byte(v), &rules); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse cacheRules: %v", err))
+		}
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid cacheRules: %v", err))
+				continue
+			}
+			if p.CacheRules[rule.ChainID] == nil {
+				p.CacheRules[rule.ChainID] = make(map[string]CacheRule)
+			}
+			p.CacheRules[rule.ChainID][rule.Method] = rule
+		}
+	}
+	p.NegativeCacheTTL = time.Duration(parseInt("negativeCacheTTL", 0)) * time.Second
+	for _, method := range splitList(value("negativeCacheMethods")) {
+		p.NegativeMethods[method] = true
+	}
+	for _, method := range splitList(value("cacheStaleMethods")) {
+		p.StaleMethods[method] = true
+	}
+	p.StaleWhileRevalidate = time.Duration(parseInt("cacheStaleWhileRevalidate", 0)) * time.Second
+	p.StaleIfError = time.Duration(parseInt("cacheStaleIfError", 0)) * time.Second
+	p.Replica = parseInt("replica", 1)
+	p.EnableRateLimit = parseBool("enableRateLimit")
+	p.RateLimitWithAuth = parseInt("rateLimitWithAuth", 0)
+	p.RateLimitWithoutAuth = parseInt("rateLimitWithoutAuth", 0)
+	for _, key := range splitList(value("apiKeys")) {
+		p.APIKeys[key] = true
+	}
+	for _, method := range splitList(value("allowedMethods")) {
+		p.AllowedMethods[method] = true
+	}
+	for _, method := range splitList(value("deniedMethods")) {
+		p.DeniedMethods[method] = true
+	}
+
+	// The chains of the config file fill in the chains not set by the flags or env variables
+	if config != nil {
+		config.applyChains(p)
+	}
+	return p, errors.Join(errs...)
+}
+
+// GetCacheRule returns the cache rule of the method on the chain: the chain's rule, the rule of every chain, or the
+// cache_ttl if it's one of the cacheable methods. The TTL & the negative TTL of the negative cache methods are filled in,
+// false if the method isn't cacheable.
+func (p *Policies) GetCacheRule(chainID int64, method string) (CacheRule, bool) {
+	rule, ok := p.CacheRules[chainID][method]
+	if !ok {
+		rule, ok = p.CacheRules[0][method]
+	}
+	if !ok {
+		if !p.CacheableMethods[method] {
+			return CacheRule{}, false
+		}
+		rule = CacheRule{Method: method}
+	}
+	if rule.TTL == 0 {
+		rule.TTL = int64(p.CacheTTL / time.Second)
+	}
+	if rule.NegativeTTL == 0 && p.NegativeMethods[method] {
+		rule.NegativeTTL = int64(p.NegativeCacheTTL / time.Second)
+	}
+	return rule, true
+}
+
+// CacheRetention returns how long a response cached by the rule is kept: the TTL, followed by the stale windows if the
+// method opted in to them
+func (p *Policies) CacheRetention(rule CacheRule) time.Duration {
+	ttl := time.Duration(rule.TTL) * time.Second
+	if !p.StaleMethods[rule.Method] {
+		return ttl
+	}
+	return ttl + max(p.StaleWhileRevalidate, p.StaleIfError)
+}
+
+func (r CacheRule) validate() error {
+	switch {
+	case r.Method == "":
+		return errors.New("method is required")
+	case r.ChainID < 0:
+		return fmt.Errorf("%s: chainID should not be negative", r.Method)
+	case r.TTL < 0 || r.NegativeTTL < 0 || r.MaxSize < 0:
+		return fmt.Errorf("%s: ttl, negativeTTL & maxSize should not be negative", r.Method)
+	case r.BlockParam != "" && r.BlockParam != BlockParamNumber && r.BlockParam != BlockParamHash && r.BlockParam != BlockParamFixed:
+		return fmt.Errorf("%s: blockParam should be number, hash or fixed, got %q", r.Method, r.BlockParam)
+	}
+	return nil
+}
+
+// GetChainPolicy returns the policy of the chain with the global defaults filled in
+func GetChainPolicy(chainID int64) ChainPolicy {
+	policy := ChainPolicy{ChainID: chainID}
+	if p, ok := GetPolicies().ChainPolicies[chainID]; ok {
+		policy = *p
+	}
+	if policy.MaxLagBlocks == nil {
+		policy.MaxLagBlocks = MaxLagBlocks
+	}
+	if policy.MaxLagSeconds == nil {
+		policy.MaxLagSeconds = MaxLagSeconds
+	}
+	if policy.HealthCheckInterval == 0 {
+		policy.HealthCheckInterval = int64(*RPCHealthCheckInterval) * 60
+	}
+	return policy
+}
+
+// LagLimits returns the lag limits of the policy in blocks & seconds, 0 if there's no limit
+func (p ChainPolicy) LagLimits() (blocks int64, seconds int64) {
+	if p.MaxLagBlocks != nil {
+		blocks = *p.MaxLagBlocks
+	}
+	if p.MaxLagSeconds != nil {
+		seconds = *p.MaxLagSeconds
+	}
+	return blocks, seconds
+}
+
+// GetUpstream returns the selection weight & tier of the rpc, the additional rpcs default to tier 0 and the chain registry
+// rpcs to the registry tier of the chain
+func GetUpstream(chainID int64, url string) Upstream {
+	p := GetPolicies()
+	upstream, ok := p.Upstreams[chainID][url]
+	if !ok {
+		upstream = Upstream{URL: url}
+		if !slices.Contains(p.AdditionalRPCs[chainID], url) {
+			upstream.Tier = GetChainPolicy(chainID).RegistryTier
+		}
+	}
+	if upstream.Weight == 0 {
+		upstream.Weight = 1
+	}
+	return upstream
+}
+
+// MethodAllowed reports whether the method may be served according to the method allow & deny lists
+func MethodAllowed(method string) bool {
+	p := GetPolicies()
+	if p.DeniedMethods[method] {
+		return false
+	}
+	return len(p.AllowedMethods) == 0 || p.AllowedMethods[method]
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/global"
+	"github.com/huahuayu/onerpc/logger"
+	"github.com/huahuayu/onerpc/routine"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminMiddleware only lets requests with the admin token through, e.g. `Authorization: Bearer <adminToken>`
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*flags.AdminToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// reloadHandler reloads the config file, on error the current config stays in place
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := routine.ReloadConfig(); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// cacheStatsHandler shows the entries of the response cache by chain & method, and the lookups, stores & evictions
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, getCacheStats())
+}
+
+// purgeCacheHandler evicts the cached responses selected by the chain (ID or name), method & key prefix query params,
+// everything with all=true
+func purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	filter := cacheFilter{method: query.Get("method"), prefix: query.Get("prefix")}
+	if chain := query.Get("chain"); chain != "" {
+		chainID, err := global.ResolveChain(chain)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		filter.chainID = strconv.FormatInt(chainID, 10)
+	}
+	if filter == (cacheFilter{}) && query.Get("all") != "true" {
+		writeJSONError(w, http.StatusBadRequest, "set chain, method or prefix, or all=true to purge everything")
+		return
+	}
+	purged := purgeCache(filter)
+	logger.Logger.Info().Str("chainID", filter.chainID).Str("method", filter.method).Str("prefix", filter.prefix).
+		Int("purged", purged).Msg("cache purged")
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
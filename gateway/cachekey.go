@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/huahuayu/onerpc/flags"
+	"strconv"
+	"strings"
+)
+
+// paramSpec describes the params of a method for the canonical cache key
+type paramSpec struct {
+	quantities []int       // positions of the quantities, e.g. block numbers & indexes
+	defaults   map[int]any // defaults of the optional trailing params by position
+}
+
+// methodParams are the params of the methods with block numbers, indexes or optional params
+var methodParams = map[string]paramSpec{
+	"eth_getBlockByNumber":                    {quantities: []int{0}, defaults: map[int]any{1: false}},
+	"eth_getBlockByHash":                      {defaults: map[int]any{1: false}},
+	"eth_getBlockTransactionCountByNumber":    {quantities: []int{0}},
+	"eth_getBlockReceipts":                    {quantities: []int{0}},
+	"eth_getTransactionByBlockNumberAndIndex": {quantities: []int{0, 1}},
+	"eth_getTransactionByBlockHashAndIndex":   {quantities: []int{1}},
+	"eth_getUncleByBlockNumberAndIndex":       {quantities: []int{0, 1}},
+	"eth_getUncleByBlockHashAndIndex":         {quantities: []int{1}},
+	"eth_getUncleCountByBlockNumber":          {quantities: []int{0}},
+	"eth_getBalance":                          {quantities: []int{1}, defaults: map[int]any{1: "latest"}},
+	"eth_getCode":                             {quantities: []int{1}, defaults: map[int]any{1: "latest"}},
+	"eth_getTransactionCount":                 {quantities: []int{1}, defaults: map[int]any{1: "latest"}},
+	"eth_getStorageAt":                        {quantities: []int{1, 2}, defaults: map[int]any{2: "latest"}},
+	"eth_call":                                {quantities: []int{1}, defaults: map[int]any{1: "latest"}},
+	"eth_estimateGas":                         {quantities: []int{1}, defaults: map[int]any{1: "latest"}},
+	"eth_getProof":                            {quantities: []int{2}, defaults: map[int]any{2: "latest"}},
+	"eth_feeHistory":                          {quantities: []int{0, 1}},
+}
+
+// quantityFields are the object fields holding quantities, e.g. of eth_getLogs filters & eth_call transactions
+var quantityFields = map[string]bool{
+	"fromBlock": true, "toBlock": true, "blockNumber": true,
+	"gas": true, "gasPrice": true, "maxFeePerGas": true, "maxPriorityFeePerGas": true, "value": true, "nonce": true,
+}
+
+// cacheKey returns the canonical key of a request: the chain ID, method and the params normalized so equivalent
+// requests share the key. Hex strings are lower-cased, quantities lose their leading zeros, omitted params with a
+// default are filled in and object fields are sorted.
+func cacheKey(chainID int64, method string, params json.RawMessage) string {
+	return strconv.FormatInt(chainID, 10) + ":" + method + ":" + normalizeParams(method, params)
+}
+
+func normalizeParams(method string, params json.RawMessage) string {
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.UseNumber()
+	var list []any
+	if len(bytes.TrimSpace(params)) == 0 || bytes.Equal(bytes.TrimSpace(params), []byte("null")) {
+		list = []any{}
+	} else if err := decoder.Decode(&list); err != nil {
+		// By-name params aren't normalized
+		return string(params)
+	}
+
+	spec := methodParams[method]
+	for {
+		value, ok := spec.defaults[len(list)]
+		if !ok {
+			break
+		}
+		list = append(list, value)
+	}
+	quantities := make(map[int]bool, len(spec.quantities))
+	for _, position := range spec.quantities {
+		quantities[position] = true
+	}
+	for i, value := range list {
+		list[i] = normalizeValue(value, quantities[i])
+	}
+	bs, err := json.Marshal(list)
+	if err != nil {
+		return string(params)
+	}
+	return string(bs)
+}
+
+func normalizeValue(value any, quantity bool) any {
+	switch v := value.(type) {
+	case string:
+		if !strings.HasPrefix(v, "0x") && !strings.HasPrefix(v, "0X") {
+			return v
+		}
+		v = "0x" + strings.ToLower(v[2:])
+		if quantity {
+			if digits := strings.TrimLeft(v[2:], "0"); digits != "" {
+				return "0x" + digits
+			}
+			return "0x0"
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeValue(item, false)
+		}
+		return v
+	case map[string]any:
+		// Marshalling sorts the fields
+		for field, item := range v {
+			v[field] = normalizeValue(item, quantityFields[field])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// blockParamMatches reports whether the block param of the request meets the condition of a cache rule: a number, a
+// hash or either (fixed), never a tag like latest. Any params match without a condition.
+func blockParamMatches(condition, method string, params json.RawMessage) bool {
+	if condition == "" {
+		return true
+	}
+	position, ok := blockParams[method]
+	if !ok {
+		return false
+	}
+	var list []any
+	if json.Unmarshal(params, &list) != nil || position >= len(list) {
+		return false
+	}
+	var number, hash any
+	switch param := list[position].(type) {
+	case string:
+		number, hash = param, param
+	case map[string]any: // EIP-1898 block param
+		number, hash = param["blockNumber"], param["blockHash"]
+	}
+	_, isNumber := blockNumber(number)
+	s, _ := hash.(string)
+	isHash := isBlockHash(s)
+	switch condition {
+	case flags.BlockParamNumber:
+		return isNumber
+	case flags.BlockParamHash:
+		return isHash
+	default:
+		return isNumber || isHash
+	}
+}
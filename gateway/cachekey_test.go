@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/huahuayu/onerpc/cache"
+	"github.com/huahuayu/onerpc/flags"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		method string
+		a, b   string
+	}{
+		// Hashes are lower-cased, the optional fullTx defaults to false
+		{"eth_getBlockByHash", `["0xABCDEF"]`, `["0xabcdef", false]`},
+		// Block numbers lose their leading zeros
+		{"eth_getBlockByNumber", `["0x00A", true]`, `["0xa", true]`},
+		// The block defaults to latest
+		{"eth_getBalance", `["0xAbC"]`, `["0xabc", "latest"]`},
+		// Filter fields are normalized & sorted
+		{"eth_getLogs", `[{"toBlock":"0x0010","fromBlock":"0x01","address":"0xAB"}]`, `[{"address":"0xab","fromBlock":"0x1","toBlock":"0x10"}]`},
+		{"eth_blockNumber", ``, `[]`},
+	}
+	for _, tt := range tests {
+		a := cacheKey(1, tt.method, json.RawMessage(tt.a))
+		b := cacheKey(1, tt.method, json.RawMessage(tt.b))
+		if a != b {
+			t.Errorf("%s: %s != %s", tt.method, a, b)
+		}
+	}
+
+	// Data isn't a quantity, its leading zeros matter
+	if cacheKey(1, "eth_getBlockByHash", json.RawMessage(`["0x00ab"]`)) == cacheKey(1, "eth_getBlockByHash", json.RawMessage(`["0xab"]`)) {
+		t.Error("hash leading zeros dropped")
+	}
+	if cacheKey(1, "eth_blockNumber", nil) == cacheKey(56, "eth_blockNumber", nil) {
+		t.Error("chains share a cache key")
+	}
+}
+
+func TestBlockParamMatches(t *testing.T) {
+	hash := `"0x` + strings.Repeat("ab", 32) + `"`
+	tests := []struct {
+		condition, method, params string
+		want                      bool
+	}{
+		{"", "eth_chainId", `[]`, true},
+		{flags.BlockParamNumber, "eth_getBlockByNumber", `["0x10",false]`, true},
+		{flags.BlockParamNumber, "eth_getBlockByNumber", `["latest",false]`, false},
+		{flags.BlockParamFixed, "eth_getCode", `["0x00000000219ab540356cbb839cbe05303d7705fa","0x10"]`, true},
+		{flags.BlockParamFixed, "eth_getCode", `["0x00000000219ab540356cbb839cbe05303d7705fa"]`, false},
+		{flags.BlockParamHash, "eth_getCode", `["0x00000000219ab540356cbb839cbe05303d7705fa",{"blockHash":` + hash + `}]`, true},
+		{flags.BlockParamHash, "eth_getCode", `["0x00000000219ab540356cbb839cbe05303d7705fa","0x10"]`, false},
+		{flags.BlockParamFixed, "eth_chainId", `[]`, false},
+	}
+	for _, tt := range tests {
+		if got := blockParamMatches(tt.condition, tt.method, json.RawMessage(tt.params)); got != tt.want {
+			t.Errorf("%s %s %s: %v, want %v", tt.condition, tt.method, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestCacheRules(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	policies := *flags.GetPolicies()
+	policies.CacheRules = map[int64]map[string]flags.CacheRule{0: {
+		"eth_getBlockByHash":        {Method: "eth_getBlockByHash", TTL: 60, MaxSize: 100},
+		"eth_getTransactionReceipt": {Method: "eth_getTransactionReceipt", TTL: 60, NegativeTTL: 60},
+	}}
+	setPolicies(t, &policies)
+
+	var calls int
+	var response string
+	handler := loggerMiddleware(cacheMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(response))
+	}))
+	send := func(method string) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/chain/1", bytes.NewReader([]byte(`{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":["0xab"]}`))))
+		return w.Header().Get(cacheStatusHeader)
+	}
+
+	// Responses over the max size aren't cached
+	response = `{"jsonrpc":"2.0","id":1,"result":"` + strings.Repeat("ab", 100) + `"}`
+	send("eth_getBlockByHash")
+	if send("eth_getBlockByHash") != "MISS" || calls != 2 {
+		t.Fatalf("response over the max size cached, %d calls", calls)
+	}
+	// Null results are cached by the negative TTL, errors never are
+	calls = 0
+	response = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"busy"}}`
+	send("eth_getTransactionReceipt")
+	response = `{"jsonrpc":"2.0","id":1,"result":null}`
+	send("eth_getTransactionReceipt")
+	if send("eth_getTransactionReceipt") != "HIT" || calls != 2 {
+		t.Fatalf("null result not negatively cached, %d calls", calls)
+	}
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"github.com/huahuayu/onerpc/metrics"
+	"strings"
+	"sync/atomic"
+)
+
+// cacheCounters are the cache lookups, stores & evictions since the start, shown by the admin cache stats
+var cacheCounters struct {
+	hits, stale, misses, stores, evictions atomic.Int64
+}
+
+// keyLabels returns the chain ID & method label values of a cache key
+func keyLabels(key string) (chainID string, method string) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 {
+		return "unknown", "unknown"
+	}
+	return parts[0], metrics.MethodLabel(parts[1])
+}
+
+// recordLookup counts a cache lookup of the key by its result: hit, stale or miss
+func recordLookup(key, result string) {
+	switch result {
+	case "hit":
+		cacheCounters.hits.Add(1)
+	case "stale":
+		cacheCounters.stale.Add(1)
+	default:
+		cacheCounters.misses.Add(1)
+	}
+	chainID, method := keyLabels(key)
+	metrics.CacheLookupsCounter.WithLabelValues(chainID, method, result).Inc()
+}
+
+func recordStore(key string) {
+	cacheCounters.stores.Add(1)
+	chainID, method := keyLabels(key)
+	metrics.CacheStoresCounter.WithLabelValues(chainID, method).Inc()
+}
+
+func recordEviction(key, reason string) {
+	cacheCounters.evictions.Add(1)
+	chainID, method := keyLabels(key)
+	metrics.CacheEvictionsCounter.WithLabelValues(chainID, method, reason).Inc()
+}
+
+// evictCache removes the keys from the cache, counting them as evicted for the reason, e.g. reorg or purge
+func evictCache(keys []string, reason string) int {
+	evicted := 0
+	for _, key := range keys {
+		if _, ok := responseCache.Pop(key); ok {
+			recordEviction(key, reason)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// onCacheExpire counts the expired responses removed by the cache cleanup
+func onCacheExpire(key string, _ *cachedResponse) {
+	recordEviction(key, "expired")
+}
+
+// cacheFilter selects cache entries by chain, method & key prefix, empty fields select all
+type cacheFilter struct {
+	chainID string
+	method  string
+	prefix  string
+}
+
+func (f cacheFilter) match(key string) bool {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 {
+		return f.chainID == "" && f.method == "" && strings.HasPrefix(key, f.prefix)
+	}
+	return (f.chainID == "" || parts[0] == f.chainID) && (f.method == "" || parts[1] == f.method) && strings.HasPrefix(key, f.prefix)
+}
+
+// purgeCache evicts the entries selected by the filter, returning how many were evicted. The entries are evicted one by
+// one, so the ones stored meanwhile are kept rather than dropped without being counted.
+func purgeCache(filter cacheFilter) int {
+	var keys []string
+	responseCache.Range(func(key string, _ *cachedResponse) bool {
+		if filter.match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return evictCache(keys, "purge")
+}
+
+// cacheStats is the /admin/cache response
+type cacheStats struct {
+	Entries   int                         `json:"entries"` // including the expired ones not cleaned up yet
+	Bytes     int                         `json:"bytes"`   // of the unexpired responses, without the compressed variants
+	Hits      int64                       `json:"hits"`
+	Stale     int64                       `json:"stale"`
+	Misses    int64                       `json:"misses"`
+	Stores    int64                       `json:"stores"`
+	Evictions int64                       `json:"evictions"`
+	Chains    map[string]*chainCacheStats `json:"chains"`
+}
+
+type chainCacheStats struct {
+	Entries int            `json:"entries"`
+	Bytes   int            `json:"bytes"`
+	Methods map[string]int `json:"methods"` // entries by method
+}
+
+func getCacheStats() cacheStats {
+	stats := cacheStats{
+		Entries:   responseCache.Len(),
+		Hits:      cacheCounters.hits.Load(),
+		Stale:     cacheCounters.stale.Load(),
+		Misses:    cacheCounters.misses.Load(),
+		Stores:    cacheCounters.stores.Load(),
+		Evictions: cacheCounters.evictions.Load(),
+		Chains:    make(map[string]*chainCacheStats),
+	}
+	responseCache.Range(func(key string, entry *cachedResponse) bool {
+		chainID, method, _ := strings.Cut(key, ":")
+		method, _, _ = strings.Cut(method, ":")
+		chain, ok := stats.Chains[chainID]
+		if !ok {
+			chain = &chainCacheStats{Methods: make(map[string]int)}
+			stats.Chains[chainID] = chain
+		}
+		chain.Entries++
+		chain.Bytes += len(entry.tail)
+		chain.Methods[method]++
+		stats.Bytes += len(entry.tail)
+		return true
+	})
+	return stats
+}
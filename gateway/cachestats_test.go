@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/cache"
+	"github.com/huahuayu/onerpc/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPurgeCache(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	keys := []string{
+		cacheKey(1, "eth_getBlockByHash", json.RawMessage(`["0xab"]`)),
+		cacheKey(1, "eth_getTransactionReceipt", json.RawMessage(`["0xcd"]`)),
+		cacheKey(56, "eth_getBlockByHash", json.RawMessage(`["0xab"]`)),
+		cacheKey(56, "eth_getTransactionReceipt", json.RawMessage(`["0xef"]`)),
+	}
+	for _, key := range keys {
+		responseCache.Set(key, &cachedResponse{tail: []byte(`,"result":"0x1"}`)})
+	}
+	purge := func(query string) (int, map[string]int) {
+		w := httptest.NewRecorder()
+		purgeCacheHandler(w, httptest.NewRequest(http.MethodPost, "/admin/cache/purge?"+query, nil))
+		var response map[string]int
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	if code, _ := purge(""); code != http.StatusBadRequest {
+		t.Fatalf("purge without a filter: %d, want %d", code, http.StatusBadRequest)
+	}
+	if _, response := purge("chain=1&method=eth_getBlockByHash"); response["purged"] != 1 {
+		t.Fatalf("purged %d by chain & method, want 1", response["purged"])
+	}
+	if _, response := purge("prefix=56:eth_getTransactionReceipt:"); response["purged"] != 1 {
+		t.Fatalf("purged %d by prefix, want 1", response["purged"])
+	}
+
+	stats := getCacheStats()
+	if stats.Entries != 2 || stats.Chains["1"].Methods["eth_getTransactionReceipt"] != 1 || stats.Chains["56"].Methods["eth_getBlockByHash"] != 1 {
+		t.Fatalf("stats after purges: %+v", stats)
+	}
+	if _, response := purge("all=true"); response["purged"] != 2 || responseCache.Len() != 0 {
+		t.Fatalf("purged %d of all, %d left", response["purged"], responseCache.Len())
+	}
+}
+
+func TestCacheEntriesGauge(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	metrics.SetCacheEntries(func() int { return responseCache.Len() })
+	responseCache.Set("1:eth_chainId:", &cachedResponse{})
+	responseCache.Set("1:net_version:", &cachedResponse{})
+	// Counted when scraped, not on every store
+	if entries := testutil.ToFloat64(metrics.CacheEntriesGauge); entries != 2 {
+		t.Fatalf("%v cache entries, want 2", entries)
+	}
+}
@@ -0,0 +1,338 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/huahuayu/onerpc/chainlist"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/global"
+	"github.com/huahuayu/onerpc/rpc"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// chainSummary is an entry of the /chains list
+type chainSummary struct {
+	ChainID        int64            `json:"chainId"`
+	Name           string           `json:"name"`
+	ShortName      string           `json:"shortName"`
+	Chain          string           `json:"chain"`
+	NativeCurrency currency         `json:"nativeCurrency"`
+	Tvl            float64          `json:"tvl"`
+	InfoURL        string           `json:"infoURL,omitempty"`
+	Explorers      []explorer       `json:"explorers,omitempty"`
+	Status         string           `json:"status,omitempty"`
+	Upstreams      upstreamsSummary `json:"upstreams"`
+}
+
+type currency struct {
+	Name     string `json:"name"`
+	Symbol   string `json:"symbol"`
+	Decimals int    `json:"decimals"`
+}
+
+type explorer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type upstreamsSummary struct {
+	Total     int `json:"total"`
+	OK        int `json:"ok"`
+	Fallbacks int `json:"fallbacks"`
+}
+
+// chainDetail is the /chains/{id} response, the upstreams are only listed by /chains/{id}/rpcs without their secrets
+type chainDetail struct {
+	chainSummary
+	NetworkID int64       `json:"networkId"`
+	Title     string      `json:"title,omitempty"`
+	Icon      string      `json:"icon,omitempty"`
+	Features  []string    `json:"features,omitempty"`
+	Faucets   []any       `json:"faucets,omitempty"`
+	Head      *rpc.Head   `json:"head,omitempty"`
+	Reorgs    []rpc.Reorg `json:"reorgs,omitempty"` // the latest reorgs detected on the followed new heads
+}
+
+// upstream is an entry of the /chains/{id}/rpcs list
+type upstream struct {
+	rpc.Stats
+	Fallback bool `json:"fallback"`
+}
+
+// chainsHandler serves the read-only chain discovery api:
+// GET /chains lists the supported chains, filtered by q, symbol, minTvl & hasRpc and sorted by sort (tvl, name, chainId, rpcs) & order
+// GET /chains/{id} shows the chain details
+// GET /chains/{id}/rpcs lists the upstreams, filtered by status & tracking and sorted by sort (latency, height, errorRate, url) & order
+func chainsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	pathParts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/chains"), "/"), "/")
+	switch {
+	case pathParts[0] == "":
+		listChains(w, r)
+	case len(pathParts) == 1:
+		getChain(w, pathParts[0])
+	case len(pathParts) == 2 && pathParts[1] == "rpcs":
+		listUpstreams(w, r, pathParts[0])
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func listChains(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search := strings.ToLower(query.Get("q"))
+	symbol := strings.ToLower(query.Get("symbol"))
+	hasRPC := query.Get("hasRpc") == "true"
+	minTvl, err := parseFloatParam(query.Get("minTvl"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid minTvl")
+		return
+	}
+
+	chains := make([]chainSummary, 0)
+	for _, chain := range global.GetChainList() {
+		if search != "" && !strings.Contains(strings.ToLower(chain.Name), search) && !strings.Contains(strings.ToLower(chain.ShortName), search) {
+			continue
+		}
+		if symbol != "" && strings.ToLower(chain.NativeCurrency.Symbol) != symbol {
+			continue
+		}
+		if chain.Tvl < minTvl {
+			continue
+		}
+		summary := summarizeChain(chain)
+		if hasRPC && summary.Upstreams.OK == 0 {
+			continue
+		}
+		chains = append(chains, summary)
+	}
+
+	desc := query.Get("order") != "asc"
+	var less func(i, j int) bool
+	switch query.Get("sort") {
+	case "", "tvl":
+		less = func(i, j int) bool { return chains[i].Tvl < chains[j].Tvl }
+	case "name":
+		less = func(i, j int) bool { return strings.ToLower(chains[i].Name) < strings.ToLower(chains[j].Name) }
+		desc = query.Get("order") == "desc"
+	case "chainId":
+		less = func(i, j int) bool { return chains[i].ChainID < chains[j].ChainID }
+		desc = query.Get("order") == "desc"
+	case "rpcs":
+		less = func(i, j int) bool { return chains[i].Upstreams.OK < chains[j].Upstreams.OK }
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid sort, should be one of tvl, name, chainId, rpcs")
+		return
+	}
+	sortStable(len(chains), less, desc, func(i, j int) { chains[i], chains[j] = chains[j], chains[i] })
+
+	total := len(chains)
+	offset, limit, err := parsePage(query.Get("offset"), query.Get("limit"), total)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"total": total, "chains": chains[offset:limit]})
+}
+
+func getChain(w http.ResponseWriter, name string) {
+	chain, ok := resolveRegistryChain(w, name)
+	if !ok {
+		return
+	}
+	detail := chainDetail{
+		chainSummary: summarizeChain(chain),
+		NetworkID:    chain.NetworkID,
+		Title:        chain.Title,
+		Icon:         chain.Icon,
+		Faucets:      chain.Faucets,
+	}
+	for _, feature := range chain.Features {
+		detail.Features = append(detail.Features, feature.Name)
+	}
+	if head, ok := rpc.GetHead(chain.ChainID); ok {
+		detail.Head = &head
+	}
+	detail.Reorgs = rpc.RecentReorgs(chain.ChainID)
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func listUpstreams(w http.ResponseWriter, r *http.Request, name string) {
+	chain, ok := resolveRegistryChain(w, name)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	status := query.Get("status")
+	tracking := query.Get("tracking")
+
+	upstreams := make([]upstream, 0)
+	rpcs, _ := global.GetRPCs(chain.ChainID)
+	fallbacks, _ := global.GetFallbackRPCs(chain.ChainID)
+	for i, r := range append(append(rpc.RPCs{}, rpcs...), fallbacks...) {
+		stats := r.Stats()
+		if status != "" && !strings.EqualFold(string(stats.Status), status) {
+			continue
+		}
+		if tracking != "" && !strings.EqualFold(stats.Tracking, tracking) {
+			continue
+		}
+		fallback := i >= len(rpcs)
+		stats.URL = publicURL(chain.ChainID, stats.URL, fallback)
+		upstreams = append(upstreams, upstream{Stats: stats, Fallback: fallback})
+	}
+
+	desc := query.Get("order") == "desc"
+	var less func(i, j int) bool
+	switch query.Get("sort") {
+	case "", "latency":
+		// Upstreams without successful calls yet go last
+		less = func(i, j int) bool {
+			if (upstreams[i].LatencyMs == 0) != (upstreams[j].LatencyMs == 0) {
+				return upstreams[j].LatencyMs == 0
+			}
+			return upstreams[i].LatencyMs < upstreams[j].LatencyMs
+		}
+	case "height":
+		less = func(i, j int) bool { return upstreams[i].Height < upstreams[j].Height }
+		desc = query.Get("order") != "asc"
+	case "errorRate":
+		less = func(i, j int) bool { return upstreams[i].ErrorRate < upstreams[j].ErrorRate }
+	case "url":
+		less = func(i, j int) bool { return upstreams[i].URL < upstreams[j].URL }
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid sort, should be one of latency, height, errorRate, url")
+		return
+	}
+	sortStable(len(upstreams), less, desc, func(i, j int) { upstreams[i], upstreams[j] = upstreams[j], upstreams[i] })
+
+	writeJSON(w, http.StatusOK, map[string]any{"chainId": chain.ChainID, "total": len(upstreams), "rpcs": upstreams})
+}
+
+// publicURL returns the url of an upstream as shown by the public api: the chain registry's urls as listed, the
+// operator's upstreams & fallbacks only by scheme & host since their paths & queries often hold api keys
+func publicURL(chainID int64, rawURL string, fallback bool) string {
+	if !fallback && !slices.Contains(flags.GetPolicies().AdditionalRPCs[chainID], rawURL) {
+		return rawURL
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "redacted"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// resolveRegistryChain resolves the chain by ID or name, writing the error response if it's not in the registry
+func resolveRegistryChain(w http.ResponseWriter, name string) (*chainlist.ChainInfo, bool) {
+	chainID, err := global.ResolveChain(name)
+	if err != nil {
+		var ambiguous *global.AmbiguousChainError
+		if errors.As(err, &ambiguous) {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return nil, false
+		}
+		writeJSONError(w, http.StatusNotFound, "chain not found")
+		return nil, false
+	}
+	chain, ok := global.GetChain(chainID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "chain not found")
+		return nil, false
+	}
+	return chain, true
+}
+
+func summarizeChain(chain *chainlist.ChainInfo) chainSummary {
+	summary := chainSummary{
+		ChainID:   chain.ChainID,
+		Name:      chain.Name,
+		ShortName: chain.ShortName,
+		Chain:     chain.Chain,
+		NativeCurrency: currency{
+			Name:     chain.NativeCurrency.Name,
+			Symbol:   chain.NativeCurrency.Symbol,
+			Decimals: chain.NativeCurrency.Decimals,
+		},
+		Tvl:     chain.Tvl,
+		InfoURL: chain.InfoURL,
+		Status:  chain.Status,
+	}
+	for _, e := range chain.Explorers {
+		summary.Explorers = append(summary.Explorers, explorer{Name: e.Name, URL: e.URL})
+	}
+	rpcs, _ := global.GetRPCs(chain.ChainID)
+	summary.Upstreams.Total = len(rpcs)
+	for _, r := range rpcs {
+		if r.Stats().Status == rpc.OK {
+			summary.Upstreams.OK++
+		}
+	}
+	fallbacks, _ := global.GetFallbackRPCs(chain.ChainID)
+	summary.Upstreams.Fallbacks = len(fallbacks)
+	return summary
+}
+
+// sortStable sorts in ascending order of less, or descending if desc is set
+func sortStable(n int, less func(i, j int) bool, desc bool, swap func(i, j int)) {
+	sort.Stable(sorter{n: n, less: func(i, j int) bool {
+		if desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	}, swap: swap})
+}
+
+type sorter struct {
+	n    int
+	less func(i, j int) bool
+	swap func(i, j int)
+}
+
+func (s sorter) Len() int           { return s.n }
+func (s sorter) Less(i, j int) bool { return s.less(i, j) }
+func (s sorter) Swap(i, j int)      { s.swap(i, j) }
+
+func parseFloatParam(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parsePage returns the bounds of the requested page, the limit defaults to all entries
+func parsePage(offsetParam string, limitParam string, total int) (start int, end int, err error) {
+	offset, limit := 0, total
+	if offsetParam != "" {
+		if offset, err = strconv.Atoi(offsetParam); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	if limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 0 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	start = min(offset, total)
+	end = min(start+limit, total)
+	return start, end, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/chainlist"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/global"
+	"github.com/huahuayu/onerpc/rpc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const operatorURL = "https://mainnet.infura.io/v3/operator-key"
+
+// setChains sets up the registry with eth & bsc, eth with a registry rpc, an operator upstream & a fallback
+func setChains(t *testing.T) {
+	oldList, oldRPCs, oldFallbacks := global.GetChainList(), global.GetRPCMap(), global.GetFallbackMap()
+	oldMap := make(map[int64]*chainlist.ChainInfo)
+	for _, chain := range oldList {
+		oldMap[chain.ChainID] = chain
+	}
+	t.Cleanup(func() {
+		global.SetChains(oldList, oldMap)
+		global.SetRPCMap(oldRPCs)
+		global.SetFallbackMap(oldFallbacks)
+	})
+	policies := *flags.GetPolicies()
+	policies.AdditionalRPCs = map[int64][]string{1: {operatorURL}}
+	setPolicies(t, &policies)
+
+	eth := &chainlist.ChainInfo{Name: "Ethereum Mainnet", ShortName: "eth", ChainID: 1, NetworkID: 1, Tvl: 100, RPC: []string{"https://registry.example", operatorURL}}
+	eth.NativeCurrency.Symbol = "ETH"
+	bsc := &chainlist.ChainInfo{Name: "BNB Smart Chain", ShortName: "bnb", ChainID: 56, NetworkID: 56, Tvl: 10}
+	bsc.NativeCurrency.Symbol = "BNB"
+	global.SetChains(chainlist.ChainList{eth, bsc}, map[int64]*chainlist.ChainInfo{1: eth, 56: bsc})
+
+	rpcs := rpc.NewRPCs(1, []string{"https://registry.example", operatorURL})
+	rpcs[0].Status = rpc.OK
+	global.SetRPCMap(map[int64]rpc.RPCs{1: rpcs})
+	global.SetFallbackMap(map[int64]rpc.RPCs{1: rpc.NewRPCs(1, []string{"https://fallback.example/key?token=secret"})})
+}
+
+func getChains(t *testing.T, method, path string, v any) (int, string) {
+	recorder := httptest.NewRecorder()
+	chainsHandler(recorder, httptest.NewRequest(method, path, nil))
+	body := recorder.Body.String()
+	if v != nil && recorder.Code == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return recorder.Code, body
+}
+
+func TestListChains(t *testing.T) {
+	setChains(t)
+	var list struct {
+		Total  int            `json:"total"`
+		Chains []chainSummary `json:"chains"`
+	}
+	if code, body := getChains(t, http.MethodGet, "/chains", &list); code != http.StatusOK || list.Total != 2 || list.Chains[0].ChainID != 1 {
+		t.Fatalf("%d %s", code, body)
+	}
+	if list.Chains[0].Upstreams != (upstreamsSummary{Total: 2, OK: 1, Fallbacks: 1}) {
+		t.Fatalf("upstreams %+v", list.Chains[0].Upstreams)
+	}
+	if _, body := getChains(t, http.MethodGet, "/chains?symbol=bnb&sort=name", &list); list.Total != 1 || list.Chains[0].ChainID != 56 {
+		t.Fatalf("symbol filter: %s", body)
+	}
+	if _, body := getChains(t, http.MethodGet, "/chains?hasRpc=true&sort=chainId&order=desc&limit=1", &list); list.Total != 1 || len(list.Chains) != 1 || list.Chains[0].ChainID != 1 {
+		t.Fatalf("hasRpc filter: %s", body)
+	}
+	for _, path := range []string{"/chains?sort=size", "/chains?minTvl=x", "/chains?limit=-1"} {
+		if code, _ := getChains(t, http.MethodGet, path, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", path, code)
+		}
+	}
+	if code, _ := getChains(t, http.MethodPost, "/chains", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", code)
+	}
+}
+
+func TestGetChain(t *testing.T) {
+	setChains(t)
+	var detail map[string]any
+	code, body := getChains(t, http.MethodGet, "/chains/eth", &detail)
+	if code != http.StatusOK || detail["chainId"] != float64(1) || detail["networkId"] != float64(1) {
+		t.Fatalf("%d %s", code, body)
+	}
+	// The upstream urls aren't part of the chain details
+	for _, field := range []string{"rpc", "rpcInfo", "wsRpc"} {
+		if _, ok := detail[field]; ok {
+			t.Errorf("%s listed", field)
+		}
+	}
+	if strings.Contains(body, "operator-key") {
+		t.Fatalf("operator url exposed: %s", body)
+	}
+	if code, _ := getChains(t, http.MethodGet, "/chains/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("unknown chain: status %d, want 404", code)
+	}
+}
+
+func TestListUpstreams(t *testing.T) {
+	setChains(t)
+	var list struct {
+		Total int        `json:"total"`
+		RPCs  []upstream `json:"rpcs"`
+	}
+	code, body := getChains(t, http.MethodGet, "/chains/1/rpcs?sort=url", &list)
+	if code != http.StatusOK || list.Total != 3 {
+		t.Fatalf("%d %s", code, body)
+	}
+	if strings.Contains(body, "operator-key") || strings.Contains(body, "secret") {
+		t.Fatalf("operator secrets exposed: %s", body)
+	}
+	urls := []string{list.RPCs[0].URL, list.RPCs[1].URL, list.RPCs[2].URL}
+	if strings.Join(urls, " ") != "https://fallback.example https://mainnet.infura.io https://registry.example" || !list.RPCs[0].Fallback {
+		t.Fatalf("urls %v", urls)
+	}
+	if _, body := getChains(t, http.MethodGet, "/chains/eth/rpcs?status=ok", &list); list.Total != 1 || list.RPCs[0].URL != "https://registry.example" {
+		t.Fatalf("status filter: %s", body)
+	}
+	if code, _ := getChains(t, http.MethodGet, "/chains/1/rpcs?sort=weight", nil); code != http.StatusBadRequest {
+		t.Errorf("invalid sort: status %d, want 400", code)
+	}
+	if code, _ := getChains(t, http.MethodGet, "/chains/1/peers", nil); code != http.StatusNotFound {
+		t.Errorf("unknown path: status %d, want 404", code)
+	}
+}
@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/metrics"
+	"golang.org/x/sync/singleflight"
+	"strconv"
+)
+
+// inFlight holds the upstream calls in flight by coalescing key
+var inFlight singleflight.Group
+
+// coalescingKey returns the key of the identical requests to serve by one upstream call, empty if the request must not
+// be coalesced. It's the canonical cache key, the privacy policy doesn't matter as only the first request is sent.
+func coalescingKey(chainID int64, method string, params json.RawMessage) string {
+	if !*flags.Coalescing || flags.UncoalescedMethods[method] {
+		return ""
+	}
+	return cacheKey(chainID, method, params)
+}
+
+// coalesce calls send once for identical requests in flight, every waiter gets the response with the JSON-RPC id of
+// its own request
+func coalesce(chainID int64, key string, body []byte, send func() ([]byte, error)) ([]byte, error) {
+	if key == "" {
+		return send()
+	}
+	response, err, shared := inFlight.Do(key, func() (any, error) {
+		return send()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		return response.([]byte), nil
+	}
+	metrics.CoalescedRequestsCounter.WithLabelValues(strconv.FormatInt(chainID, 10)).Inc()
+	var request struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	return withID(response.([]byte), request.ID)
+}
+
+// withID returns the JSON-RPC response with the id replaced, the shared response itself is left untouched
+func withID(response []byte, id json.RawMessage) ([]byte, error) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(response, &message); err != nil {
+		return nil, err
+	}
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	if bytes.Equal(message["id"], id) {
+		return response, nil
+	}
+	message["id"] = id
+	return json.Marshal(message)
+}
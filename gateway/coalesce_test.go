@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/huahuayu/onerpc/flags"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	setFlag(t, &flags.UncoalescedMethods, map[string]bool{"eth_sendRawTransaction": true})
+	key := coalescingKey(1, "eth_blockNumber", json.RawMessage("[]"))
+	if key == "" {
+		t.Fatal("eth_blockNumber should be coalesced")
+	}
+	if coalescingKey(1, "eth_sendRawTransaction", json.RawMessage(`["0x00"]`)) != "" {
+		t.Fatal("eth_sendRawTransaction should never be coalesced")
+	}
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	send := func() ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte(`{"jsonrpc":"2.0","id":0,"result":"0x10"}`), nil
+	}
+
+	const waiters = 10
+	responses := make([][]byte, waiters)
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":"client-%d","method":"eth_blockNumber","params":[]}`, i))
+			response, err := coalesce(1, key, body, send)
+			if err != nil {
+				t.Error(err)
+			}
+			responses[i] = response
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond) // let every waiter join the call in flight
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("%d upstream calls, want 1", calls.Load())
+	}
+	for i, response := range responses {
+		var message struct {
+			ID     string `json:"id"`
+			Result string `json:"result"`
+		}
+		if err := json.Unmarshal(response, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.ID != fmt.Sprintf("client-%d", i) || message.Result != "0x10" {
+			t.Errorf("waiter %d got %s", i, response)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/huahuayu/onerpc/codec"
+	"github.com/huahuayu/onerpc/flags"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// compressionMiddleware decodes compressed request bodies and compresses the responses as accepted by the client.
+// Responses that are already encoded, e.g. compressed cache hits, are passed through.
+func compressionMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !*flags.Compression {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				return
+			}
+			decoded, err := codec.Decode(encoding, body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(decoded))
+			r.ContentLength = int64(len(decoded))
+			r.Header.Del("Content-Encoding")
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := codec.Negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == codec.Identity {
+			next.ServeHTTP(w, r)
+			return
+		}
+		buffered := &bufferedWriter{ResponseWriter: w}
+		next.ServeHTTP(buffered, r)
+		body := buffered.body.Bytes()
+		if len(body) >= *flags.CompressMinSize && w.Header().Get("Content-Encoding") == "" {
+			if encoded, err := codec.Encode(encoding, body); err == nil {
+				w.Header().Set("Content-Encoding", encoding)
+				body = encoded
+			}
+		}
+		buffered.writeTo(body)
+	}
+}
+
+// bufferedWriter captures the status code & body of a response, the headers go to the underlying writer
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// writeTo writes the captured status code with the body to the underlying writer
+func (b *bufferedWriter) writeTo(body []byte) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	b.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	b.ResponseWriter.WriteHeader(b.status)
+	b.ResponseWriter.Write(body)
+}
+
+// cachedResponse is a cached JSON-RPC response without its id, it's served with the id of each request. The response
+// after the id is compressed once per encoding, per request only the few bytes up to the id are, so compressed cache hits
+// skip nearly all the work.
+type cachedResponse struct {
+	tail       []byte // the response after the id, e.g. `,"result":"0x1"}`
+	expires    time.Time
+	refreshing atomic.Bool // a background refresh of the stale response is running
+	mutex      sync.Mutex
+	variants   map[string][]byte // compressed tails by encoding
+}
+
+func newCachedResponse(response []byte) (*cachedResponse, error) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(response, &message); err != nil {
+		return nil, err
+	}
+	delete(message, "jsonrpc")
+	delete(message, "id")
+	fields, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	tail := []byte("}")
+	if len(message) > 0 {
+		tail = append([]byte(","), fields[1:]...)
+	}
+	return &cachedResponse{tail: tail, variants: make(map[string][]byte)}, nil
+}
+
+// head returns the response up to the id
+func head(id json.RawMessage) []byte {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return append([]byte(`{"jsonrpc":"2.0","id":`), id...)
+}
+
+// encoded returns the response with the id in the encoding accepted by the client, small responses stay plain
+func (c *cachedResponse) encoded(r *http.Request, id json.RawMessage) ([]byte, string) {
+	plain := append(head(id), c.tail...)
+	if !*flags.Compression || len(plain) < *flags.CompressMinSize {
+		return plain, codec.Identity
+	}
+	encoding := codec.Negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == codec.Identity {
+		return plain, codec.Identity
+	}
+
+	c.mutex.Lock()
+	tail, ok := c.variants[encoding]
+	if !ok {
+		var err error
+		if tail, err = codec.EncodeSuffix(encoding, c.tail); err != nil {
+			c.mutex.Unlock()
+			return plain, codec.Identity
+		}
+		c.variants[encoding] = tail
+	}
+	c.mutex.Unlock()
+
+	encoded, err := codec.EncodePrefixed(encoding, head(id), c.tail, tail)
+	if err != nil {
+		return plain, codec.Identity
+	}
+	return encoded, encoding
+}
+
+// write serves the cached response with the id in the encoding accepted by the client
+func (c *cachedResponse) write(w http.ResponseWriter, r *http.Request, id json.RawMessage) {
+	body, encoding := c.encoded(r, id)
+	w.Header().Set("Content-Type", "application/json")
+	if encoding != codec.Identity {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
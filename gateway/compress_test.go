@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/huahuayu/onerpc/codec"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressionMiddleware(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"hash":"0x0"}`), 200)
+	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "small" {
+			w.Write(body)
+			return
+		}
+		w.Write(large)
+	})
+
+	// Compressed request bodies are decoded, responses are compressed as accepted
+	request, err := codec.Encode(codec.Gzip, []byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/chain/1", bytes.NewReader(request))
+	r.Header.Set("Content-Encoding", codec.Gzip)
+	r.Header.Set("Accept-Encoding", "gzip, zstd")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != codec.Zstd {
+		t.Fatalf("content encoding = %q, want zstd", encoding)
+	}
+	decoded, err := codec.Decode(codec.Zstd, w.Body.Bytes())
+	if err != nil || !bytes.Equal(decoded, large) {
+		t.Fatalf("unexpected response body, err: %v", err)
+	}
+
+	// Small responses stay plain
+	r = httptest.NewRequest(http.MethodPost, "/chain/1", bytes.NewReader([]byte("small")))
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "small" {
+		t.Fatalf("small response compressed")
+	}
+
+	// Unsupported request encodings are rejected
+	r = httptest.NewRequest(http.MethodPost, "/chain/1", bytes.NewReader([]byte("large")))
+	r.Header.Set("Content-Encoding", "br")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestCachedResponse(t *testing.T) {
+	result := `"` + strings.Repeat("ab", 1000) + `"`
+	entry, err := newCachedResponse([]byte(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"jsonrpc":"2.0","id":"client-2","result":` + result + `}`
+
+	r := httptest.NewRequest(http.MethodPost, "/chain/1", nil)
+	if plain, encoding := entry.encoded(r, json.RawMessage(`"client-2"`)); encoding != codec.Identity || string(plain) != want {
+		t.Fatalf("plain response %s, want %s", plain, want)
+	}
+	// The compressed tail is kept, every client gets its own id
+	for _, encoding := range codec.Supported {
+		r.Header.Set("Accept-Encoding", encoding)
+		for i := 0; i < 2; i++ {
+			body, got := entry.encoded(r, json.RawMessage(`"client-2"`))
+			if got != encoding {
+				t.Fatalf("encoding = %q, want %q", got, encoding)
+			}
+			decoded, err := codec.Decode(encoding, body)
+			if err != nil || string(decoded) != want {
+				t.Fatalf("%s: decoded %s, err: %v", encoding, decoded, err)
+			}
+		}
+		if _, ok := entry.variants[encoding]; !ok {
+			t.Fatalf("%s tail not kept", encoding)
+		}
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/huahuayu/onerpc/cache"
 	"github.com/huahuayu/onerpc/flags"
 	"github.com/huahuayu/onerpc/global"
 	"github.com/huahuayu/onerpc/logger"
+	"github.com/huahuayu/onerpc/metrics"
 	"github.com/huahuayu/onerpc/rpc"
 	"io"
 	"net"
@@ -16,6 +19,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,7 +33,10 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	return rw.Writer.Write(b)
 }
 
-var validApiKeys = make(map[string]bool)
+var (
+	validApiKeys        = make(map[string]bool)
+	generateAPIKeysOnce sync.Once
+)
 
 func generateAndStoreAPIKeys() {
 	for i := 0; i < 10; i++ {
@@ -59,89 +67,244 @@ func generateAndStoreAPIKeys() {
 	logger.Logger.Info().Any("keys", validApiKeys).Msg("API keys generated")
 }
 
-// Create a cache with a clean tick of 1 minutes
+// The caches are sharded, so the requests of different keys don't contend for one lock
 var (
-	responseCache  cache.ICache[string, []byte]
+	responseCache  cache.ICache[string, *cachedResponse]
 	rateLimitCache cache.ICache[string, int]
 )
 
 func Init() {
-	responseCache = cache.New[string, []byte](time.Duration(*flags.CacheTTL) * time.Minute)
-	rateLimitCache = cache.New[string, int](1 * time.Second)
+	responseCache = cache.NewSharded[string, *cachedResponse](0, 1*time.Second)
+	rateLimitCache = cache.NewSharded[string, int](0, 1*time.Second)
+	responseCache.OnExpire(onCacheExpire)
+	metrics.SetCacheEntries(func() int { return responseCache.Len() })
+	rpc.OnReorg(evictReorg)
+	rpc.OnHead(dropNegative)
+	go pruneBlockIndex()
+}
+
+// privateOnlySegment is the path segment selecting only rpcs that don't track, e.g. /chain/1/private-only
+const privateOnlySegment = "private-only"
+
+// chainPath is the parsed /chain/{chainID}[/private-only][/{apiKey}] path
+type chainPath struct {
+	chain       string
+	apiKey      string
+	privateOnly bool
+}
+
+func parseChainPath(path string) chainPath {
+	var parsed chainPath
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) < 3 {
+		return parsed
+	}
+	parsed.chain = pathParts[2]
+	for _, part := range pathParts[3:] {
+		if part == privateOnlySegment {
+			parsed.privateOnly = true
+		} else if parsed.apiKey == "" {
+			parsed.apiKey = part
+		}
+	}
+	return parsed
+}
+
+// requestPrivacyPolicy returns the privacy policy of the request, clients can choose a stricter policy than the operator's
+// by the X-Privacy-Policy header or the private-only path segment
+func requestPrivacyPolicy(r *http.Request) (rpc.PrivacyPolicy, error) {
+	policy := rpc.PrivacyPolicy(*flags.PrivacyPolicy)
+	if header := r.Header.Get("X-Privacy-Policy"); header != "" {
+		clientPolicy, err := rpc.ParsePrivacyPolicy(header)
+		if err != nil {
+			return "", err
+		}
+		policy = policy.Stricter(clientPolicy)
+	}
+	if parseChainPath(r.URL.Path).privateOnly {
+		policy = policy.Stricter(rpc.PrivacyNone)
+	}
+	return policy, nil
 }
 
 // Handler for /chain/ endpoint
 func chainHandler(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.URL.Path, "/")
+	path := parseChainPath(r.URL.Path)
 
-	// Ensure there's enough parts in the path for the chainID
-	if len(pathParts) < 3 {
+	// Ensure there's a chainID in the path
+	if path.chain == "" {
 		http.Error(w, "Invalid URL format", http.StatusBadRequest)
 		return
 	}
 
-	chainId, err := strconv.ParseInt(pathParts[2], 10, 64)
+	chainId, err := global.ResolveChain(path.chain)
 	if err != nil {
-		logger.Logger.Error().Msgf("Invalid chainID: %s", err)
+		var ambiguous *global.AmbiguousChainError
+		if errors.As(err, &ambiguous) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Logger.Error().Msgf("Invalid chainID: %s", path.chain)
 		http.Error(w, "Invalid chainID", http.StatusBadRequest)
 		return
 	}
 
-	rpcs, ok := global.RPCMap[chainId]
+	policy, err := requestPrivacyPolicy(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rpcs, ok := global.GetRPCs(chainId)
 	if !ok {
-		logger.Logger.Error().Msgf("No node found for the given chainID: %s", chainId)
+		logger.Logger.Error().Msgf("No node found for the given chainID: %d", chainId)
 		http.Error(w, "No node found for the given chainID", http.StatusNotFound)
 		return
 	}
+	rpcs = rpcs.FilterPrivacy(policy)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
 		return
 	}
 	// Check if body is a valid JSON
-	var jsonBody map[string]interface{}
-	if err := json.Unmarshal(body, &jsonBody); err != nil {
+	var request struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
 		http.Error(w, "Invalid JSONRPC request", http.StatusBadRequest)
 		return
 	}
-	response, origins, err := rpcs.SendRequest(body, *flags.Replica, nil)
+	if !flags.MethodAllowed(request.Method) {
+		writeJSON(w, http.StatusForbidden, map[string]any{
+			"jsonrpc": "2.0",
+			"id":      request.ID,
+			"error":   map[string]any{"code": -32601, "message": "method not allowed: " + request.Method},
+		})
+		return
+	}
+	key := coalescingKey(chainId, request.Method, request.Params)
+	response, err := coalesce(chainId, key, body, func() ([]byte, error) {
+		return sendRequest(chainId, rpcs, policy, body)
+	})
 	if err != nil {
-		// Retry if the first request failed, exclude previous origins
-		var secondOrigins rpc.RPCs
-		response, secondOrigins, err = rpcs.SendRequest(body, 1, origins)
-		if err != nil {
-			// Retry if the second request failed, exclude both previous origins
-			exclude := append(origins, secondOrigins...)
-			response, _, err = rpcs.SendRequest(body, 1, exclude)
-			if err != nil {
-				// Use fallback node if all retry failed
-				fallbackRPCs, _ := global.FallbackMap[chainId]
-				if fallbackRPCs != nil {
-					response, _, err = fallbackRPCs.SendRequest(body, 1, nil)
-				}
-				if err != nil {
-					logger.Logger.Error().Msgf("Error sending request: %s", err)
-					http.Error(w, "Error sending request: "+err.Error(), http.StatusTooManyRequests)
-					return
-				}
-			}
-		}
+		logger.Logger.Error().Msgf("Error sending request: %s", err)
+		http.Error(w, "Error sending request: "+err.Error(), http.StatusTooManyRequests)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Privacy-Policy", string(policy))
 	w.Write(response)
 }
 
+// sendRequest sends the request to the rpcs, retrying twice with other rpcs and then with the fallback rpcs
+func sendRequest(chainId int64, rpcs rpc.RPCs, policy rpc.PrivacyPolicy, body []byte) ([]byte, error) {
+	response, origins, err := rpcs.SendRequest(body, flags.GetPolicies().Replica, nil)
+	if err == nil {
+		return response, nil
+	}
+	// Retry if the first request failed, exclude previous origins
+	response, secondOrigins, err := rpcs.SendRequest(body, 1, origins)
+	if err == nil {
+		return response, nil
+	}
+	// Retry if the second request failed, exclude both previous origins
+	exclude := append(origins, secondOrigins...)
+	response, _, err = rpcs.SendRequest(body, 1, exclude)
+	if err == nil {
+		return response, nil
+	}
+	// Use fallback node if all retry failed
+	fallbackRPCs, _ := global.GetFallbackRPCs(chainId)
+	fallbackRPCs = fallbackRPCs.FilterPrivacy(policy)
+	if len(fallbackRPCs) > 0 {
+		response, _, err = fallbackRPCs.SendRequest(body, 1, nil)
+	}
+	return response, err
+}
+
+// rootHandler serves chain names at the root, e.g. /eth is the same as /chain/eth
+func rootHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := global.ResolveChain(name); errors.Is(err, global.ErrUnknownChain) {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = "/chain" + r.URL.Path
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	}
+}
+
+var (
+	server *http.Server
+	// draining is set once the shutdown started, the readiness probe fails from then on
+	draining atomic.Bool
+)
+
+// StartGatewayServer serves the gateway in the background until Shutdown
 func StartGatewayServer() {
-	http.HandleFunc("/chain/", loggerMiddleware(authMiddleware(cacheMiddleware(chainHandler))))
+	chain := loggerMiddleware(authMiddleware(cacheMiddleware(chainHandler)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chain/", chain)
+	mux.HandleFunc("/chains", chainsHandler)
+	mux.HandleFunc("/chains/", chainsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	if *flags.AdminToken != "" {
+		mux.HandleFunc("/admin/reload", adminMiddleware(reloadHandler))
+		mux.HandleFunc("/admin/cache", adminMiddleware(cacheStatsHandler))
+		mux.HandleFunc("/admin/cache/purge", adminMiddleware(purgeCacheHandler))
+	}
+	mux.HandleFunc("/", rootHandler(chain))
 	port := *flags.Port
-	if *flags.EnableRateLimit {
-		generateAndStoreAPIKeys()
+	if policies := flags.GetPolicies(); policies.EnableRateLimit && len(policies.APIKeys) == 0 {
+		generateAPIKeysOnce.Do(generateAndStoreAPIKeys)
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		panic("Failed to load tls config: " + err.Error())
 	}
-	logger.Logger.Info().Msgf("Starting gateway server on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		panic("Failed to start server: " + err.Error())
+	server = &http.Server{Addr: ":" + port, Handler: compressionMiddleware(mux.ServeHTTP), TLSConfig: tlsConfig, Protocols: protocols()}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			logger.Logger.Info().Msgf("Starting gateway server on port %s with tls", port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			logger.Logger.Info().Msgf("Starting gateway server on port %s", port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic("Failed to start server: " + err.Error())
+		}
+	}()
+}
+
+// Drain fails the readiness probe so the load balancers stop routing new requests here, the server keeps serving
+func Drain() {
+	draining.Store(true)
+}
+
+// Shutdown stops accepting connections and waits for the in-flight requests until ctx is done
+func Shutdown(ctx context.Context) error {
+	Drain()
+	if server == nil {
+		return nil
 	}
+	err := server.Shutdown(ctx)
+	// Stop the cache cleanups once the requests are drained
+	responseCache.Close()
+	rateLimitCache.Close()
+	return err
 }
 
 func loggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -165,15 +328,20 @@ func loggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		ctx := context.WithValue(r.Context(), "requestID", requestID)
 		r = r.WithContext(ctx)
 
-		// Extract the method & params from the request
+		// Extract the id, method & params from the request
 		var rpcRequest struct {
-			Method string        `json:"method"`
-			Params []interface{} `json:"params"`
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
 		}
 		if err := json.NewDecoder(bytes.NewBuffer(body)).Decode(&rpcRequest); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// Add id to the context, cached & coalesced responses get the id of the request
+		ctx = context.WithValue(r.Context(), "id", rpcRequest.ID)
+		r = r.WithContext(ctx)
+
 		// Add method to the context
 		if rpcRequest.Method != "" {
 			ctx = context.WithValue(r.Context(), "method", rpcRequest.Method)
@@ -181,16 +349,12 @@ func loggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Add params to the context
-		bs, err := json.Marshal(rpcRequest.Params)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		params := string(bs)
-		if params != "" {
-			ctx = context.WithValue(r.Context(), "params", params)
-			r = r.WithContext(ctx)
+		params := string(rpcRequest.Params)
+		if params == "" {
+			params = "null"
 		}
+		ctx = context.WithValue(r.Context(), "params", params)
+		r = r.WithContext(ctx)
 
 		// Extract the IP address from the request
 		ip := getIPAddress(r)
@@ -217,11 +381,13 @@ func loggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			method = methodCtx.(string)
 		}
 
+		metrics.RequestsCounter.WithLabelValues(chainLabel(r), metrics.MethodLabel(method)).Inc()
+
 		// Log the request and response info
 		logger.Logger.Info().
 			Str("requestID", requestID.String()).
 			Str("ip", ip).
-			Str("chainID", strings.Split(r.URL.Path, "/")[2]).
+			Str("chainID", parseChainPath(r.URL.Path).chain).
 			Str("method", method).
 			Str("timeUsed", duration.String()).
 			Msg("reqInfo")
@@ -231,9 +397,13 @@ func loggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			Str("request", string(body)).
 			Msg("request")
 
+		response := buffer.String()
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			response = fmt.Sprintf("<%s encoded, %d bytes>", encoding, buffer.Len())
+		}
 		logger.Logger.Debug().
 			Str("requestID", requestID.String()).
-			Str("response", buffer.String()).
+			Str("response", response).
 			Msg("response")
 	}
 }
@@ -256,12 +426,6 @@ func cacheMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 		method := methodCtx.(string)
 
-		// Check if the method should be cached
-		if !flags.CacheableMethods[method] {
-			next.ServeHTTP(w, r)
-			return
-		}
-
 		// Get params from the context
 		paramsCtx := r.Context().Value("params")
 		if paramsCtx == nil {
@@ -270,84 +434,161 @@ func cacheMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 		params := paramsCtx.(string)
 
-		// Generate a cache key using the method and parameters
-		cacheKey := r.URL.String() + "-" + method + "-" + params
+		// Check if the method should be cached on the chain with these params
+		chainID, err := global.ResolveChain(parseChainPath(r.URL.Path).chain)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policies := flags.GetPolicies()
+		rule, ok := policies.GetCacheRule(chainID, method)
+		if !ok || !blockParamMatches(rule.BlockParam, method, json.RawMessage(params)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The cache is shared by all clients of the chain, the key is canonical so equivalent requests share it
+		key := cacheKey(chainID, method, json.RawMessage(params))
+		id, _ := r.Context().Value("id").(json.RawMessage)
 
 		// Check if the request has a Cache-Control header
 		cacheControl := r.Header.Get("Cache-Control")
 
-		// Try to get the response from the cache
-		cachedResponse, found := responseCache.Get(cacheKey)
+		// Try to get the response from the cache, expired responses of the methods opted in are served within the stale
+		// windows: at once while refreshed in the background, or when all upstreams fail
+		var stale *cachedResponse
+		cached, found := responseCache.Get(key)
 		if found && cacheControl != "no-cache" {
+			switch staleFor := cached.staleFor(); {
+			case staleFor <= 0:
+				recordLookup(key, "hit")
+				logger.Logger.Debug().
+					Str("requestID", requestID.String()).
+					Str("chainID", parseChainPath(r.URL.Path).chain).
+					Str("method", method).
+					Msg("cacheHit")
+				w.Header().Set(cacheStatusHeader, "HIT")
+				cached.write(w, r, id)
+				return
+			case !policies.StaleMethods[method]:
+			case staleFor <= policies.StaleWhileRevalidate:
+				recordLookup(key, "stale")
+				cached.revalidate(next, r, chainID, key, rule)
+				w.Header().Set(cacheStatusHeader, "STALE")
+				cached.write(w, r, id)
+				return
+			case staleFor <= policies.StaleIfError:
+				stale = cached
+			}
+		}
+		recordLookup(key, "miss")
+
+		// Capture the response, so it's compressed once for both the cache & the client
+		buffered := &bufferedWriter{ResponseWriter: w}
+		next.ServeHTTP(buffered, r)
+		if stale != nil && buffered.status > http.StatusOK {
 			logger.Logger.Debug().
 				Str("requestID", requestID.String()).
-				Str("chainID", strings.Split(r.URL.Path, "/")[2]).
+				Str("chainID", parseChainPath(r.URL.Path).chain).
 				Str("method", method).
-				Msg("cacheHit")
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(cachedResponse)
+				Msg("staleIfError")
+			w.Header().Set(cacheStatusHeader, "STALE")
+			stale.write(w, r, id)
 			return
 		}
-
-		// Create a buffer to capture the response
-		var buffer bytes.Buffer
-
-		// Create a multiwriter that writes to both the original http.ResponseWriter and the buffer
-		multiWriter := io.MultiWriter(w, &buffer)
-
-		// Replace the http.ResponseWriter with our multiwriter
-		w = &responseWriter{ResponseWriter: w, Writer: multiWriter}
-
-		// Call the next middleware function
-		next.ServeHTTP(w, r)
-
-		// Verify if the response is valid JSON & result is not null
-		var result map[string]interface{}
-		err := json.Unmarshal(buffer.Bytes(), &result)
-		if err != nil {
+		w.Header().Set(cacheStatusHeader, "MISS")
+		if entry := storeResponse(r, chainID, key, rule, buffered); entry != nil {
+			entry.write(w, r, id)
 			return
 		}
-		if result["result"] == nil || result["result"] == "" || result["result"] == "null" {
-			return
+		buffered.writeTo(buffered.body.Bytes())
+	}
+}
+
+// storeResponse caches the captured response of the request by the cache rule if it's a valid result, nil if it isn't.
+// Empty & null results are only cached with a negative TTL, until the chain head moves on. The other entries are
+// indexed by their blocks, so a reorg evicts them.
+func storeResponse(r *http.Request, chainID int64, key string, rule flags.CacheRule, buffered *bufferedWriter) *cachedResponse {
+	body := buffered.body.Bytes()
+	if buffered.status > http.StatusOK || (rule.MaxSize > 0 && len(body) > rule.MaxSize) {
+		return nil
+	}
+	// Verify if the response is valid JSON & result is not null
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil
+	}
+	if _, failed := result["error"]; failed {
+		return nil
+	}
+	policies := flags.GetPolicies()
+	ttl, retention := time.Duration(rule.TTL)*time.Second, policies.CacheRetention(rule)
+	negative := result["result"] == nil || result["result"] == "" || result["result"] == "null"
+	if negative {
+		if rule.NegativeTTL == 0 {
+			return nil
 		}
+		ttl = time.Duration(rule.NegativeTTL) * time.Second
+		retention = ttl
+	}
 
-		// Store the response in the cache
-		responseCache.Set(cacheKey, buffer.Bytes(), time.Duration(*flags.CacheTTL)*time.Minute)
+	// Store the response in the cache
+	entry, err := newCachedResponse(body)
+	if err != nil {
+		return nil
+	}
+	method, _ := r.Context().Value("method").(string)
+	params, _ := r.Context().Value("params").(string)
+	entry.expires = time.Now().Add(ttl)
+	responseCache.Set(key, entry, retention)
+	recordStore(key)
+	if negative {
+		trackNegative(chainID, key, method, json.RawMessage(params), entry)
+	} else {
+		indexBlocks(chainID, key, method, json.RawMessage(params), result["result"])
 	}
+	return entry
 }
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !*flags.EnableRateLimit {
+		policies := flags.GetPolicies()
+		if !policies.EnableRateLimit {
 			next.ServeHTTP(w, r)
 			return
 		}
-		pathParts := strings.Split(r.URL.Path, "/")
-
+		// Rate limits can be enabled by a config reload, the keys are generated once if none are configured
+		if len(policies.APIKeys) == 0 {
+			generateAPIKeysOnce.Do(generateAndStoreAPIKeys)
+		}
 		var apiKey string
 		var isApiKeyValid bool
 
 		// Check if an API key is provided
-		if len(pathParts) >= 4 {
-			apiKey = pathParts[3]
-			isApiKeyValid = validateApiKey(apiKey)
+		if path := parseChainPath(r.URL.Path); path.apiKey != "" {
+			apiKey = path.apiKey
+			isApiKeyValid = validateApiKey(policies, apiKey)
 
 			// If an API key is provided but not valid, deny the request
 			if !isApiKeyValid {
 				http.Error(w, "Invalid API key", http.StatusUnauthorized)
 				return
 			}
+		} else if key := clientCertAPIKey(r); key != "" {
+			// A client certificate mapped to an API key authenticates like the key in the path
+			apiKey = key
+			isApiKeyValid = validateApiKey(policies, apiKey)
 		}
 
 		// Define rate limits
 		var rateLimit int
 		if isApiKeyValid {
-			rateLimit = *flags.RateLimitWithAuth
+			rateLimit = policies.RateLimitWithAuth
 			if rateLimit == 0 {
 				rateLimit = int(^uint(0) >> 1)
 			}
 		} else {
-			rateLimit = *flags.RateLimitWithoutAuth // rate limit for no API key
+			rateLimit = policies.RateLimitWithoutAuth // rate limit for no API key
 		}
 
 		// Check rate limit for the IP or API key
@@ -370,7 +611,10 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 }
 
 // Validate if the provided API key is valid (dummy implementation, replace with your actual validation logic)
-func validateApiKey(apiKey string) bool {
+func validateApiKey(policies *flags.Policies, apiKey string) bool {
+	if len(policies.APIKeys) > 0 {
+		return policies.APIKeys[apiKey]
+	}
 	_, exists := validApiKeys[apiKey]
 	return exists
 }
@@ -383,6 +627,16 @@ func getRateLimitKey(r *http.Request, apiKey string, isApiKeyValid bool) string
 	return "ip:" + getIPAddress(r)
 }
 
+// chainLabel returns the chain ID of the request path as label value, the path is sent by clients so unknown chains
+// are reported as "unknown"
+func chainLabel(r *http.Request) string {
+	chainID, err := global.ResolveChain(parseChainPath(r.URL.Path).chain)
+	if err != nil {
+		return "unknown"
+	}
+	return strconv.FormatInt(chainID, 10)
+}
+
 func getIPAddress(r *http.Request) string {
 	// Try to get the real IP from the X-Forwarded-For header
 	forwarded := r.Header.Get("X-Forwarded-For")
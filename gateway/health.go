@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/global"
+	"github.com/huahuayu/onerpc/rpc"
+	"net/http"
+	"slices"
+)
+
+// readiness is the breakdown of the readiness probe, Reasons explains why it fails
+type readiness struct {
+	Status         string           `json:"status"` // ready, not_ready or draining
+	RegistryLoaded bool             `json:"registryLoaded"`
+	Chains         []chainReadiness `json:"chains"`
+	Reasons        []string         `json:"reasons,omitempty"`
+}
+
+type chainReadiness struct {
+	ChainID   int64          `json:"chainId"`
+	Ready     bool           `json:"ready"`
+	Available int            `json:"available"` // OK and within the lag threshold
+	Required  int            `json:"required"`
+	Upstreams map[string]int `json:"upstreams"` // number of upstreams per status, OK ones lagging behind count as stale
+}
+
+// healthHandler is the liveness probe, it passes as long as the process serves requests
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyHandler is the readiness probe, it passes once the chain registry is loaded and every chain of readyChains has
+// readyMinUpstreams available upstreams. It fails once the shutdown started so no new requests are routed here.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	result := checkReadiness()
+	status := http.StatusOK
+	if result.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, result)
+}
+
+func checkReadiness() readiness {
+	result := readiness{
+		Status:         "ready",
+		RegistryLoaded: len(global.GetChainList()) > 0,
+		Chains:         make([]chainReadiness, 0, len(flags.ReadyChains)),
+	}
+	if !result.RegistryLoaded {
+		result.Reasons = append(result.Reasons, "chain registry not loaded")
+	}
+	for _, chainID := range flags.ReadyChains {
+		chain := chainReadiness{ChainID: chainID, Required: *flags.ReadyMinUpstreams, Upstreams: make(map[string]int)}
+		rpcs, ok := global.GetRPCs(chainID)
+		available := rpcs.Available()
+		for _, r := range rpcs {
+			status := r.Stats().Status
+			if status == rpc.OK && !slices.Contains(available, r) {
+				status = "stale"
+			}
+			chain.Upstreams[string(status)]++
+		}
+		chain.Available = len(available)
+		chain.Ready = chain.Available >= chain.Required
+		switch {
+		case !ok || len(rpcs) == 0:
+			result.Reasons = append(result.Reasons, fmt.Sprintf("chain %d: no upstreams", chainID))
+		case !chain.Ready:
+			result.Reasons = append(result.Reasons, fmt.Sprintf("chain %d: %d of %d required upstreams available", chainID, chain.Available, chain.Required))
+		}
+		result.Chains = append(result.Chains, chain)
+	}
+	if len(result.Reasons) > 0 {
+		result.Status = "not_ready"
+	}
+	if draining.Load() {
+		result.Status = "draining"
+		result.Reasons = append(result.Reasons, "shutting down")
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/huahuayu/onerpc/cache"
+	"github.com/huahuayu/onerpc/chainlist"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/global"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getReadiness(t *testing.T) (int, readiness) {
+	recorder := httptest.NewRecorder()
+	readyHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var result readiness
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, result
+}
+
+func TestReadyz(t *testing.T) {
+	setChains(t)
+	setFlag(t, &flags.ReadyChains, []int64{1})
+	setFlag(t, flags.ReadyMinUpstreams, 1)
+	t.Cleanup(func() { draining.Store(false) })
+
+	if code, result := getReadiness(t); code != http.StatusOK || result.Status != "ready" || !result.Chains[0].Ready {
+		t.Fatalf("%d %+v", code, result)
+	}
+
+	// Only one of the two upstreams is OK
+	setFlag(t, flags.ReadyMinUpstreams, 2)
+	if code, result := getReadiness(t); code != http.StatusServiceUnavailable || result.Status != "not_ready" ||
+		result.Chains[0].Available != 1 || len(result.Reasons) != 1 {
+		t.Fatalf("too few upstreams: %d %+v", code, result)
+	}
+	*flags.ReadyMinUpstreams = 1
+
+	global.SetChains(chainlist.ChainList{}, map[int64]*chainlist.ChainInfo{})
+	if code, result := getReadiness(t); code != http.StatusServiceUnavailable || result.Status != "not_ready" || result.RegistryLoaded {
+		t.Fatalf("registry not loaded: %d %+v", code, result)
+	}
+
+	draining.Store(true)
+	if code, result := getReadiness(t); code != http.StatusServiceUnavailable || result.Status != "draining" {
+		t.Fatalf("draining: %d %+v", code, result)
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	setFlag(t, &responseCache, cache.NewSharded[string, *cachedResponse](0))
+	setFlag(t, &rateLimitCache, cache.NewSharded[string, int](0))
+	t.Cleanup(func() { draining.Store(false) })
+
+	started := make(chan struct{})
+	var served atomic.Bool
+	setFlag(t, &server, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+		served.Store(true)
+	})})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !draining.Load() {
+		t.Error("not draining after shutdown")
+	}
+	if !served.Load() {
+		t.Fatal("shutdown returned before the in-flight request was served")
+	}
+	if r := <-results; r.err != nil || r.body != "done" {
+		t.Fatalf("in-flight request: %q %v", r.body, r.err)
+	}
+}
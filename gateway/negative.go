@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// negativeEntry is a cached not found result and the block it awaits: the block param of the lookup, or 0 if any new
+// block may resolve it, e.g. by mining a pending transaction
+type negativeEntry struct {
+	entry *cachedResponse
+	block int64
+}
+
+// negativeEntries are the cached not found results by chain & cache key
+var negativeEntries = struct {
+	sync.Mutex
+	byChain map[int64]map[string]negativeEntry
+}{byChain: make(map[int64]map[string]negativeEntry)}
+
+// trackNegative records a cached not found result, so it's dropped once the chain head moves on
+func trackNegative(chainID int64, key, method string, params json.RawMessage, entry *cachedResponse) {
+	var block int64
+	if numbers, _ := responseBlocks(method, params, nil); len(numbers) > 0 {
+		block = numbers[0]
+	}
+	negativeEntries.Lock()
+	defer negativeEntries.Unlock()
+	if negativeEntries.byChain[chainID] == nil {
+		negativeEntries.byChain[chainID] = make(map[string]negativeEntry)
+	}
+	negativeEntries.byChain[chainID][key] = negativeEntry{entry: entry, block: block}
+}
+
+// dropNegative evicts the not found results the new head may resolve before their TTL ends: the lookups of any block,
+// and those of a block number once the head reaches it. The cache is looked up without holding the lock.
+func dropNegative(chainID int64, head int64) {
+	type candidate struct {
+		key   string
+		entry *cachedResponse
+	}
+	var candidates []candidate
+	negativeEntries.Lock()
+	for key, negative := range negativeEntries.byChain[chainID] {
+		if negative.block > head {
+			continue
+		}
+		delete(negativeEntries.byChain[chainID], key)
+		candidates = append(candidates, candidate{key, negative.entry})
+	}
+	negativeEntries.Unlock()
+
+	var keys []string
+	for _, c := range candidates {
+		// The key may have been cached again with a result since
+		if cached, ok := responseCache.Get(c.key); ok && cached == c.entry {
+			keys = append(keys, c.key)
+		}
+	}
+	if len(keys) > 0 {
+		evictCache(keys, "mined")
+	}
+}
+
+// pruneNegative drops the not found results no longer cached, looking them up in the cache without holding the lock
+func pruneNegative() {
+	type entryRef struct {
+		chainID int64
+		key     string
+		entry   *cachedResponse
+	}
+	var entries []entryRef
+	negativeEntries.Lock()
+	for chainID, chainEntries := range negativeEntries.byChain {
+		for key, negative := range chainEntries {
+			entries = append(entries, entryRef{chainID, key, negative.entry})
+		}
+	}
+	negativeEntries.Unlock()
+
+	var uncached []entryRef
+	for _, ref := range entries {
+		if cached, ok := responseCache.Get(ref.key); !ok || cached != ref.entry {
+			uncached = append(uncached, ref)
+		}
+	}
+
+	negativeEntries.Lock()
+	defer negativeEntries.Unlock()
+	for _, ref := range uncached {
+		chainEntries := negativeEntries.byChain[ref.chainID]
+		// The key may have been tracked again since
+		if negative, ok := chainEntries[ref.key]; ok && negative.entry == ref.entry {
+			delete(chainEntries, ref.key)
+		}
+		if len(chainEntries) == 0 {
+			delete(negativeEntries.byChain, ref.chainID)
+		}
+	}
+}
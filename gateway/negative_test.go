@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/cache"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropNegative(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	txHash := "0x" + strings.Repeat("ab", 32)
+	store := func(method, params string) string {
+		key := cacheKey(1, method, json.RawMessage(params))
+		entry := &cachedResponse{}
+		responseCache.Set(key, entry, time.Minute)
+		trackNegative(1, key, method, json.RawMessage(params), entry)
+		return key
+	}
+	receipt := store("eth_getTransactionReceipt", `["`+txHash+`"]`)
+	futureBlock := store("eth_getBlockByNumber", `["0x20",false]`)
+	replaced := store("eth_getTransactionByHash", `["`+txHash+`"]`)
+	responseCache.Set(replaced, &cachedResponse{}, time.Minute)
+
+	dropNegative(1, 0x10)
+	if _, ok := responseCache.Get(receipt); ok {
+		t.Error("not found receipt kept after a new head")
+	}
+	if _, ok := responseCache.Get(futureBlock); !ok {
+		t.Error("not found block dropped before the head reached it")
+	}
+	if _, ok := responseCache.Get(replaced); !ok {
+		t.Error("result cached since the not found result dropped")
+	}
+
+	dropNegative(1, 0x20)
+	if _, ok := responseCache.Get(futureBlock); ok {
+		t.Error("not found block kept after the head reached it")
+	}
+}
+
+func TestPruneNegative(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	t.Cleanup(func() {
+		negativeEntries.Lock()
+		defer negativeEntries.Unlock()
+		delete(negativeEntries.byChain, 2)
+	})
+	cached, expired, replaced := cacheKey(2, "eth_getBlockByNumber", json.RawMessage(`["0x20",false]`)), cacheKey(2, "eth_getBlockByNumber", json.RawMessage(`["0x21",false]`)), cacheKey(2, "eth_getBlockByNumber", json.RawMessage(`["0x22",false]`))
+	for _, key := range []string{cached, expired, replaced} {
+		entry := &cachedResponse{}
+		trackNegative(2, key, "eth_getBlockByNumber", nil, entry)
+		if key != expired {
+			responseCache.Set(key, entry, time.Minute)
+		}
+	}
+	responseCache.Set(replaced, &cachedResponse{}, time.Minute)
+
+	pruneNegative()
+	negativeEntries.Lock()
+	defer negativeEntries.Unlock()
+	if _, ok := negativeEntries.byChain[2][cached]; !ok || len(negativeEntries.byChain[2]) != 1 {
+		t.Fatalf("not found results %v, want only the cached one", negativeEntries.byChain[2])
+	}
+}
@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/logger"
+	"github.com/huahuayu/onerpc/rpc"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blockParams are the positions of the block number or hash param of the methods
+var blockParams = map[string]int{
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockByHash":                      0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getBlockTransactionCountByHash":      0,
+	"eth_getBlockReceipts":                    0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getTransactionByBlockHashAndIndex":   0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getUncleByBlockHashAndIndex":         0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getUncleCountByBlockHash":            0,
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_getStorageAt":                        2,
+	"eth_call":                                1,
+	"eth_getProof":                            2,
+}
+
+type numberRef struct {
+	chainID int64
+	number  int64
+}
+
+type hashRef struct {
+	chainID int64
+	hash    string
+}
+
+// blockIndex is the cache keys of the responses by the blocks they depend on, so a reorg evicts them
+var blockIndex = struct {
+	sync.Mutex
+	byNumber map[numberRef]map[string]bool
+	byHash   map[hashRef]map[string]bool
+	// indexed is the keys indexed while a prune looks them up in the cache, nil if no prune runs
+	indexed map[string]bool
+}{byNumber: make(map[numberRef]map[string]bool), byHash: make(map[hashRef]map[string]bool)}
+
+// blockIndexPruneInterval is how often the keys no longer cached are dropped from the block index
+var blockIndexPruneInterval = time.Minute
+
+// indexBlocks indexes the cache key by the blocks of the request params & the decoded result
+func indexBlocks(chainID int64, key, method string, params json.RawMessage, result any) {
+	numbers, hashes := responseBlocks(method, params, result)
+	if len(numbers) == 0 && len(hashes) == 0 {
+		return
+	}
+	blockIndex.Lock()
+	defer blockIndex.Unlock()
+	if blockIndex.indexed != nil {
+		blockIndex.indexed[key] = true
+	}
+	for _, number := range numbers {
+		ref := numberRef{chainID, number}
+		if blockIndex.byNumber[ref] == nil {
+			blockIndex.byNumber[ref] = make(map[string]bool)
+		}
+		blockIndex.byNumber[ref][key] = true
+	}
+	for _, hash := range hashes {
+		ref := hashRef{chainID, hash}
+		if blockIndex.byHash[ref] == nil {
+			blockIndex.byHash[ref] = make(map[string]bool)
+		}
+		blockIndex.byHash[ref][key] = true
+	}
+}
+
+// responseBlocks returns the numbers & hashes of the blocks a response depends on: the block param of the request and
+// the blocks of the result, e.g. of a block, transaction or receipts
+func responseBlocks(method string, params json.RawMessage, result any) (numbers []int64, hashes []string) {
+	add := func(number, hash any) {
+		if n, ok := blockNumber(number); ok {
+			numbers = append(numbers, n)
+		}
+		if h, ok := hash.(string); ok && isBlockHash(h) {
+			hashes = append(hashes, strings.ToLower(h))
+		}
+	}
+	if position, ok := blockParams[method]; ok {
+		var list []any
+		if json.Unmarshal(params, &list) == nil && position < len(list) {
+			switch param := list[position].(type) {
+			case string:
+				add(param, param)
+			case map[string]any: // EIP-1898 block param
+				add(param["blockNumber"], param["blockHash"])
+			}
+		}
+	}
+
+	objects := []any{result}
+	if list, ok := result.([]any); ok {
+		objects = list
+	}
+	for _, object := range objects {
+		fields, ok := object.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := fields["blockHash"]; ok {
+			add(fields["blockNumber"], fields["blockHash"])
+		} else if _, ok := fields["parentHash"]; ok {
+			add(fields["number"], fields["hash"])
+		}
+	}
+	return numbers, hashes
+}
+
+func blockNumber(value any) (int64, bool) {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, "0x") || isBlockHash(s) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[2:], 16, 64)
+	return n, err == nil
+}
+
+func isBlockHash(s string) bool {
+	return len(s) == 66 && strings.HasPrefix(s, "0x")
+}
+
+// evictReorg evicts the cached responses of the replaced blocks
+func evictReorg(reorg rpc.Reorg) {
+	var keys []string
+	blockIndex.Lock()
+	for _, number := range reorg.Numbers() {
+		ref := numberRef{reorg.ChainID, number}
+		for key := range blockIndex.byNumber[ref] {
+			keys = append(keys, key)
+		}
+		delete(blockIndex.byNumber, ref)
+	}
+	for _, hash := range reorg.Hashes {
+		ref := hashRef{reorg.ChainID, strings.ToLower(hash)}
+		for key := range blockIndex.byHash[ref] {
+			keys = append(keys, key)
+		}
+		delete(blockIndex.byHash, ref)
+	}
+	blockIndex.Unlock()
+
+	evicted := evictCache(keys, "reorg")
+	logger.Logger.Info().
+		Str("chainID", strconv.FormatInt(reorg.ChainID, 10)).
+		Int64("number", reorg.Number).
+		Int("depth", reorg.Depth).
+		Int("evicted", evicted).
+		Msg("reorged blocks evicted from the cache")
+}
+
+// pruneBlockIndex periodically drops the keys no longer cached from the block index & the not found results
+func pruneBlockIndex() {
+	ticker := time.NewTicker(blockIndexPruneInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pruneNegative()
+		pruneBlocks()
+	}
+}
+
+// pruneBlocks drops the keys no longer cached from the block index, the keys are looked up in the cache without holding
+// the index lock so the cached responses are indexed meanwhile
+func pruneBlocks() {
+	keys := make(map[string]bool)
+	blockIndex.Lock()
+	for _, refKeys := range blockIndex.byNumber {
+		maps.Copy(keys, refKeys)
+	}
+	for _, refKeys := range blockIndex.byHash {
+		maps.Copy(keys, refKeys)
+	}
+	blockIndex.indexed = make(map[string]bool)
+	blockIndex.Unlock()
+
+	for key := range keys {
+		if _, ok := responseCache.Get(key); ok {
+			delete(keys, key)
+		}
+	}
+
+	blockIndex.Lock()
+	defer blockIndex.Unlock()
+	// A key cached again since it was looked up stays indexed
+	for key := range blockIndex.indexed {
+		delete(keys, key)
+	}
+	blockIndex.indexed = nil
+	if len(keys) == 0 {
+		return
+	}
+	for ref, refKeys := range blockIndex.byNumber {
+		pruneKeys(refKeys, keys)
+		if len(refKeys) == 0 {
+			delete(blockIndex.byNumber, ref)
+		}
+	}
+	for ref, refKeys := range blockIndex.byHash {
+		pruneKeys(refKeys, keys)
+		if len(refKeys) == 0 {
+			delete(blockIndex.byHash, ref)
+		}
+	}
+}
+
+func pruneKeys(keys, uncached map[string]bool) {
+	for key := range keys {
+		if uncached[key] {
+			delete(keys, key)
+		}
+	}
+}
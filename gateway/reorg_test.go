@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/cache"
+	"github.com/huahuayu/onerpc/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictReorg(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	blockHash := "0x" + strings.Repeat("ab", 32)
+	otherHash := "0x" + strings.Repeat("cd", 32)
+	store := func(method, params, result string) string {
+		var decoded any
+		if err := json.Unmarshal([]byte(result), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		key := cacheKey(1, method, json.RawMessage(params))
+		responseCache.Set(key, &cachedResponse{})
+		indexBlocks(1, key, method, json.RawMessage(params), decoded)
+		return key
+	}
+	byNumber := store("eth_getBlockByNumber", `["0x10",false]`, `{"number":"0x10","hash":"`+blockHash+`","parentHash":"`+otherHash+`"}`)
+	countByHash := store("eth_getBlockTransactionCountByHash", `["`+blockHash+`"]`, `"0x5"`)
+	receipt := store("eth_getTransactionReceipt", `["`+otherHash+`"]`, `{"blockNumber":"0x10","blockHash":"`+blockHash+`","status":"0x1"}`)
+	older := store("eth_getBlockByNumber", `["0xf",false]`, `{"number":"0xf","hash":"`+otherHash+`","parentHash":"`+otherHash+`"}`)
+
+	evictReorg(rpc.Reorg{ChainID: 1, Number: 0x10, Depth: 1, Hashes: []string{blockHash}})
+	for _, key := range []string{byNumber, countByHash, receipt} {
+		if _, ok := responseCache.Get(key); ok {
+			t.Errorf("%s not evicted", key)
+		}
+	}
+	if _, ok := responseCache.Get(older); !ok {
+		t.Error("response of a block before the reorg evicted")
+	}
+}
+
+func TestPruneBlocks(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	cached, expired := cacheKey(2, "eth_getBlockByNumber", json.RawMessage(`["0x20",false]`)), cacheKey(2, "eth_getBlockByNumber", json.RawMessage(`["0x21",false]`))
+	responseCache.Set(cached, &cachedResponse{})
+	indexBlocks(2, cached, "eth_getBlockByNumber", json.RawMessage(`["0x20",false]`), nil)
+	indexBlocks(2, expired, "eth_getBlockByNumber", json.RawMessage(`["0x21",false]`), nil)
+	t.Cleanup(func() {
+		blockIndex.Lock()
+		defer blockIndex.Unlock()
+		delete(blockIndex.byNumber, numberRef{2, 0x20})
+		delete(blockIndex.byNumber, numberRef{2, 0x21})
+	})
+
+	pruneBlocks()
+	blockIndex.Lock()
+	defer blockIndex.Unlock()
+	if !blockIndex.byNumber[numberRef{2, 0x20}][cached] {
+		t.Error("cached key pruned")
+	}
+	if _, ok := blockIndex.byNumber[numberRef{2, 0x21}]; ok {
+		t.Error("key no longer cached kept")
+	}
+	if blockIndex.indexed != nil {
+		t.Error("indexed keys kept after the prune")
+	}
+}
@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/logger"
+	"io"
+	"net/http"
+	"time"
+)
+
+// cacheStatusHeader tells the client how the cache served the response: HIT, MISS or STALE
+const cacheStatusHeader = "X-Cache-Status"
+
+// staleFor returns how long the response has been expired, not positive while it's fresh
+func (c *cachedResponse) staleFor() time.Duration {
+	return time.Since(c.expires)
+}
+
+// revalidate refreshes the stale response of the request in the background, once at a time. The refreshed response
+// replaces it in the cache, on failure it stays until the stale windows end.
+func (c *cachedResponse) revalidate(next http.HandlerFunc, r *http.Request, chainID int64, key string, rule flags.CacheRule) {
+	if !c.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		c.refreshing.Store(false)
+		return
+	}
+	refresh := r.Clone(context.WithoutCancel(r.Context()))
+	refresh.Body = io.NopCloser(bytes.NewReader(body))
+	go func() {
+		defer c.refreshing.Store(false)
+		buffered := &bufferedWriter{ResponseWriter: &detachedWriter{header: make(http.Header)}}
+		next.ServeHTTP(buffered, refresh)
+		if storeResponse(refresh, chainID, key, rule, buffered) == nil {
+			logger.Logger.Debug().Str("key", key).Int("status", buffered.status).Msg("stale response refresh failed")
+		}
+	}()
+}
+
+// detachedWriter is the response writer of requests made by the gateway itself, without a client to respond to
+type detachedWriter struct {
+	header http.Header
+}
+
+func (d *detachedWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *detachedWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *detachedWriter) WriteHeader(int) {}
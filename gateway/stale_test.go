@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"bytes"
+	"github.com/huahuayu/onerpc/cache"
+	"github.com/huahuayu/onerpc/flags"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setPolicies sets the policies for the test only
+func setPolicies(t *testing.T, p *flags.Policies) {
+	old := flags.GetPolicies()
+	flags.SetPolicies(p)
+	t.Cleanup(func() { flags.SetPolicies(old) })
+}
+
+func TestStaleResponses(t *testing.T) {
+	setFlag(t, &responseCache, cache.New[string, *cachedResponse](time.Minute))
+	policies := *flags.GetPolicies()
+	policies.CacheableMethods = map[string]bool{"eth_getBlockByHash": true, "eth_getTransactionByHash": true}
+	policies.StaleMethods = map[string]bool{"eth_getBlockByHash": true}
+	policies.CacheTTL = 0 // responses are stale at once
+	policies.StaleWhileRevalidate = time.Hour
+	setPolicies(t, &policies)
+
+	var calls atomic.Int32
+	var failing atomic.Bool
+	handler := loggerMiddleware(cacheMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			http.Error(w, "Error sending request: all upstreams failed", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x1"}}`))
+	}))
+	send := func(method string) *httptest.ResponseRecorder {
+		body := `{"jsonrpc":"2.0","id":2,"method":"` + method + `","params":["0xab",false]}`
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/chain/1", bytes.NewReader([]byte(body))))
+		return w
+	}
+
+	if w := send("eth_getBlockByHash"); w.Header().Get(cacheStatusHeader) != "MISS" {
+		t.Fatalf("first request %s", w.Header().Get(cacheStatusHeader))
+	}
+	// Stale while revalidate: served at once, refreshed in the background
+	w := send("eth_getBlockByHash")
+	if w.Header().Get(cacheStatusHeader) != "STALE" || w.Body.String() != `{"jsonrpc":"2.0","id":2,"result":{"number":"0x1"}}` {
+		t.Fatalf("stale response %s: %s", w.Header().Get(cacheStatusHeader), w.Body)
+	}
+	for deadline := time.Now().Add(time.Second); calls.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stale response not refreshed")
+		}
+	}
+
+	// Stale if error: served once all upstreams fail
+	ifError := policies
+	ifError.StaleWhileRevalidate, ifError.StaleIfError = 0, time.Hour
+	flags.SetPolicies(&ifError)
+	failing.Store(true)
+	if w := send("eth_getBlockByHash"); w.Code != http.StatusOK || w.Header().Get(cacheStatusHeader) != "STALE" {
+		t.Fatalf("upstream failure served %d %s", w.Code, w.Header().Get(cacheStatusHeader))
+	}
+
+	// Methods not opted in aren't served stale
+	failing.Store(false)
+	send("eth_getTransactionByHash")
+	failing.Store(true)
+	if w := send("eth_getTransactionByHash"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("stale response served for a method not opted in: %d", w.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes
+var certCheckInterval = 10 * time.Second
+
+// newTLSConfig returns the tls config of the gateway from the certificate files or the ACME CA, nil if tls is disabled
+func newTLSConfig() (*tls.Config, error) {
+	var config *tls.Config
+	switch {
+	case len(flags.ACMEDomains) > 0:
+		config = newACMEManager().TLSConfig()
+	case *flags.TLSCert != "":
+		certs, err := newCertReloader(*flags.TLSCert, *flags.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{GetCertificate: certs.GetCertificate}
+	default:
+		return nil, nil
+	}
+	config.MinVersion = tls.VersionTLS12
+
+	if *flags.TLSClientCA != "" {
+		pem, err := os.ReadFile(*flags.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *flags.TLSClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if *flags.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// newACMEManager gets & renews the certificates of the acme domains with the tls-alpn-01 challenge
+func newACMEManager() *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(flags.ACMEDomains...),
+		Cache:      autocert.DirCache(*flags.ACMECacheDir),
+		Email:      *flags.ACMEEmail,
+	}
+	if *flags.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: *flags.ACMEDirectoryURL}
+	}
+	return manager
+}
+
+// protocols returns the protocols served by the gateway, HTTP/2 is served over tls and, with h2c, without tls
+func protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(*flags.H2C)
+	return p
+}
+
+// certReloader serves the certificate of the cert & key files, reloading them once they change. A failed reload keeps
+// the current certificate, e.g. while the files are being replaced.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time // latest modification time of the files when loaded
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	c.checked = time.Now()
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if err := c.reload(); err != nil {
+			logger.Logger.Warn().Str("error", err.Error()).Msg("tls certificate reload failed, keeping the current certificate")
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate if the files changed since the last load
+func (c *certReloader) reload() error {
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	logger.Logger.Info().Str("cert", c.certFile).Msg("tls certificate loaded")
+	return nil
+}
+
+// clientCertAPIKey returns the API key of the verified client certificate by its common name, DNS names or email
+// addresses, empty if there is none or it isn't mapped
+func clientCertAPIKey(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, name := range names {
+		if key, ok := flags.ClientCertKeys[name]; ok && name != "" {
+			return key
+		}
+	}
+	return ""
+}
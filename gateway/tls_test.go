@@ -0,0 +1,247 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/huahuayu/onerpc/flags"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate issued by parent, self-signed without parent
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var testSerial atomic.Int64
+
+func newTestCert(t *testing.T, commonName string, parent *testCert, usage ...x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial.Add(1)),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  usage,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// writeFiles writes the certificate & key files, modified at modTime
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	for file, content := range map[string][]byte{certFile: c.certPEM(), keyFile: c.keyPEM(t)} {
+		if err := os.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setFlag sets the flag for the test only
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+func TestCertReloader(t *testing.T) {
+	setFlag(t, &certCheckInterval, 0)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+
+	first := newTestCert(t, "localhost", nil)
+	first.writeFiles(t, certFile, keyFile, start)
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() *big.Int {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber
+	}
+	if served().Cmp(first.cert.SerialNumber) != 0 {
+		t.Fatal("first certificate not served")
+	}
+
+	second := newTestCert(t, "localhost", nil)
+	second.writeFiles(t, certFile, keyFile, start.Add(time.Minute))
+	if served().Cmp(second.cert.SerialNumber) != 0 {
+		t.Fatal("changed certificate not reloaded")
+	}
+
+	// A half written key pair keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if served().Cmp(second.cert.SerialNumber) != 0 {
+		t.Fatal("current certificate dropped by a failed reload")
+	}
+}
+
+func TestClientCertAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", nil)
+	serverCert := newTestCert(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	serverCert.writeFiles(t, certFile, keyFile, time.Now())
+	if err := os.WriteFile(caFile, ca.certPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, flags.TLSCert, certFile)
+	setFlag(t, flags.TLSKey, keyFile)
+	setFlag(t, flags.TLSClientCA, caFile)
+	setFlag(t, &flags.ClientCertKeys, map[string]string{"alice": "key1"})
+
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientCertAPIKey(r))
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) string {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs}}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	clientCert := func(c *testCert) tls.Certificate {
+		return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+	}
+
+	if key := get(clientCert(newTestCert(t, "alice", ca, x509.ExtKeyUsageClientAuth))); key != "key1" {
+		t.Fatalf("api key = %q, want key1", key)
+	}
+	if key := get(clientCert(newTestCert(t, "bob", ca, x509.ExtKeyUsageClientAuth))); key != "" {
+		t.Fatalf("unmapped certificate got api key %q", key)
+	}
+	if key := get(); key != "" {
+		t.Fatalf("request without certificate got api key %q", key)
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	// A local stand-in for the ACME CA, the cached certificate is served without contacting it
+	var contacted atomic.Bool
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contacted.Store(true)
+		http.Error(w, "unexpected ACME request", http.StatusInternalServerError)
+	}))
+	defer ca.Close()
+
+	dir := t.TempDir()
+	cached := newTestCert(t, "rpc.example.com", nil)
+	if err := os.WriteFile(filepath.Join(dir, "rpc.example.com"), append(cached.keyPEM(t), cached.certPEM()...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &flags.ACMEDomains, []string{"rpc.example.com"})
+	setFlag(t, flags.ACMECacheDir, dir)
+	setFlag(t, flags.ACMEDirectoryURL, ca.URL)
+
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cached.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "rpc.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Hosts besides the acme domains are rejected before contacting the CA
+	if conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.com"}); err == nil {
+		conn.Close()
+		t.Fatal("certificate served for a host not in the acme domains")
+	}
+	if contacted.Load() {
+		t.Fatal("ACME CA contacted")
+	}
+}
@@ -1,10 +1,156 @@
 package global
 
 import (
+	"errors"
+	"fmt"
+	"github.com/huahuayu/onerpc/chainlist"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/logger"
 	"github.com/huahuayu/onerpc/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// The maps are swapped as a whole on every chain info refresh and never modified after being set,
+// so the maps returned by the getters can be read without holding the lock
 var (
-	RPCMap      map[int64]rpc.RPCs
-	FallbackMap map[int64]rpc.RPCs
+	mutex       sync.RWMutex
+	rpcMap      map[int64]rpc.RPCs
+	fallbackMap map[int64]rpc.RPCs
 )
+
+// GetRPCs returns the rpcs of the chain
+func GetRPCs(chainID int64) (rpc.RPCs, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	rpcs, ok := rpcMap[chainID]
+	return rpcs, ok
+}
+
+// GetFallbackRPCs returns the fallback rpcs of the chain
+func GetFallbackRPCs(chainID int64) (rpc.RPCs, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	rpcs, ok := fallbackMap[chainID]
+	return rpcs, ok
+}
+
+// GetRPCMap returns the rpcs of all chains, the map must not be modified
+func GetRPCMap() map[int64]rpc.RPCs {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return rpcMap
+}
+
+// GetFallbackMap returns the fallback rpcs of all chains, the map must not be modified
+func GetFallbackMap() map[int64]rpc.RPCs {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return fallbackMap
+}
+
+// SetRPCMap swaps the rpcs of all chains
+func SetRPCMap(m map[int64]rpc.RPCs) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	rpcMap = m
+}
+
+// SetFallbackMap swaps the fallback rpcs of all chains
+func SetFallbackMap(m map[int64]rpc.RPCs) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	fallbackMap = m
+}
+
+var (
+	chainMutex sync.RWMutex
+	chainList  chainlist.ChainList
+	chainMap   map[int64]*chainlist.ChainInfo
+	chainNames map[string][]int64 // lower case short name to chain IDs
+)
+
+// ErrUnknownChain is returned by ResolveChain for names that are neither a chain ID, an alias nor a short name
+var ErrUnknownChain = errors.New("unknown chain")
+
+// AmbiguousChainError is returned by ResolveChain for a short name shared by several chains
+type AmbiguousChainError struct {
+	Name     string
+	ChainIDs []int64
+}
+
+func (e *AmbiguousChainError) Error() string {
+	ids := make([]string, 0, len(e.ChainIDs))
+	for _, id := range e.ChainIDs {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return fmt.Sprintf("chain name %s is ambiguous, use one of the chain IDs: %s", e.Name, strings.Join(ids, ", "))
+}
+
+// SetChains swaps the chain registry and rebuilds the short name index
+func SetChains(list chainlist.ChainList, m map[int64]*chainlist.ChainInfo) {
+	names := make(map[string][]int64)
+	for _, chain := range list {
+		if chain.ShortName == "" {
+			continue
+		}
+		name := strings.ToLower(chain.ShortName)
+		names[name] = append(names[name], chain.ChainID)
+	}
+	ambiguous := make([]string, 0)
+	for name, ids := range names {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if _, aliased := flags.ChainAliases[name]; len(ids) > 1 && !aliased {
+			ambiguous = append(ambiguous, name)
+		}
+	}
+	if len(ambiguous) > 0 {
+		sort.Strings(ambiguous)
+		logger.Logger.Warn().Strs("shortNames", ambiguous).Msg("short names shared by several chains can't be used in routes, add an alias to pick one")
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+	chainList = list
+	chainMap = m
+	chainNames = names
+}
+
+// GetChainList returns the chain registry sorted by Tvl in descending order, the list must not be modified
+func GetChainList() chainlist.ChainList {
+	chainMutex.RLock()
+	defer chainMutex.RUnlock()
+	return chainList
+}
+
+// GetChain returns the registry entry of the chain
+func GetChain(chainID int64) (*chainlist.ChainInfo, bool) {
+	chainMutex.RLock()
+	defer chainMutex.RUnlock()
+	chain, ok := chainMap[chainID]
+	return chain, ok
+}
+
+// ResolveChain resolves a chain ID, an operator defined alias or a registry short name to the chain ID, case-insensitively
+func ResolveChain(name string) (int64, error) {
+	if chainID, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return chainID, nil
+	}
+	name = strings.ToLower(name)
+	if chainID, ok := flags.ChainAliases[name]; ok {
+		return chainID, nil
+	}
+
+	chainMutex.RLock()
+	ids := chainNames[name]
+	chainMutex.RUnlock()
+	switch len(ids) {
+	case 0:
+		return 0, ErrUnknownChain
+	case 1:
+		return ids[0], nil
+	}
+	return 0, &AmbiguousChainError{Name: name, ChainIDs: ids}
+}
@@ -0,0 +1,47 @@
+package global
+
+import (
+	"errors"
+	"github.com/huahuayu/onerpc/chainlist"
+	"github.com/huahuayu/onerpc/flags"
+	"testing"
+)
+
+func TestResolveChain(t *testing.T) {
+	list := chainlist.ChainList{
+		{ChainID: 1, ShortName: "eth"},
+		{ChainID: 42161, ShortName: "arb1"},
+		{ChainID: 7, ShortName: "dup"},
+		{ChainID: 8, ShortName: "DUP"},
+	}
+	m := make(map[int64]*chainlist.ChainInfo)
+	for _, chain := range list {
+		m[chain.ChainID] = chain
+	}
+	SetChains(list, m)
+	flags.ChainAliases["bsc"] = 56
+
+	tests := []struct {
+		name string
+		want int64
+	}{
+		{"1", 1},
+		{"eth", 1},
+		{"ETH", 1},
+		{"Arb1", 42161},
+		{"bsc", 56},
+	}
+	for _, tt := range tests {
+		if got, err := ResolveChain(tt.name); err != nil || got != tt.want {
+			t.Errorf("ResolveChain(%s) = %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := ResolveChain("unknown"); !errors.Is(err, ErrUnknownChain) {
+		t.Errorf("expected ErrUnknownChain, got %v", err)
+	}
+	var ambiguous *AmbiguousChainError
+	if _, err := ResolveChain("dup"); !errors.As(err, &ambiguous) || len(ambiguous.ChainIDs) != 2 {
+		t.Errorf("expected an AmbiguousChainError, got %v", err)
+	}
+}
@@ -1,27 +1,63 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"github.com/huahuayu/onerpc/flags"
 	"github.com/huahuayu/onerpc/gateway"
 	"github.com/huahuayu/onerpc/logger"
 	"github.com/huahuayu/onerpc/metrics"
 	"github.com/huahuayu/onerpc/routine"
+	"github.com/huahuayu/onerpc/www"
 	"net/http"
 	_ "net/http/pprof" // Import for side-effect to register pprof handlers
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 	flags.Init()
 	logger.Init(*flags.LogLevel, *flags.LogCaller)
+
+	// Subcommands
+	switch flag.Arg(0) {
+	case "export-chains":
+		// Save the chain registry as a snapshot for offline mode, e.g. `onerpc export-chains ./data/chains.json`
+		path := *flags.ChainSnapshot
+		if flag.Arg(1) != "" {
+			path = flag.Arg(1)
+		}
+		if err := routine.ExportChainList(path); err != nil {
+			logger.Logger.Fatal().Str("error", err.Error()).Msg("export chains")
+		}
+		return
+	case "config":
+		// Validate the config file, env variables & flags and print the effective config, e.g. `onerpc --config=config.yaml config check`
+		// Invalid settings already made flags.Init exit
+		if flag.Arg(1) != "check" {
+			logger.Logger.Fatal().Msgf("unknown config command: %s, should be check", flag.Arg(1))
+		}
+		fmt.Println("config is valid, effective config:")
+		flags.PrintConfig(os.Stdout)
+		return
+	case "":
+	default:
+		logger.Logger.Fatal().Msgf("unknown command: %s", flag.Arg(0))
+	}
+
 	gateway.Init()
 	logger.Logger.Info().Msg("refreshing chain info...")
 	routine.RefreshChainInfo()
-	go gateway.StartGatewayServer()
+	routine.FollowHeads()
+	gateway.StartGatewayServer()
 	if *flags.Metrics {
-		go metrics.StartServer()
+		metrics.StartServer()
+	}
+	if *flags.Dashboard {
+		www.StartServer()
 	}
 
 	if *flags.Pprof {
@@ -29,8 +65,34 @@ func main() {
 		go http.ListenAndServe(":6060", nil)
 	}
 
+	// Reload the config on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			logger.Logger.Info().Msg("SIGHUP received, reloading config...")
+			routine.ReloadConfig()
+		}
+	}()
+
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 	<-shutdown
 	logger.Logger.Info().Msg("shutting down the server...")
+
+	// Fail the readiness probe first, so the load balancers stop routing new requests here while we still serve them
+	gateway.Drain()
+	time.Sleep(time.Duration(*flags.ShutdownDelay) * time.Second)
+
+	// Stop accepting connections and drain the in-flight requests, the metrics stay up until the gateway is drained
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*flags.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := gateway.Shutdown(ctx); err != nil {
+		logger.Logger.Warn().Str("error", err.Error()).Msg("in-flight requests not drained before the shutdown timeout")
+	}
+	www.Shutdown(ctx)
+	metrics.Shutdown(ctx)
+	routine.Stop()
+	// The cache & request counters are in memory only, there's nothing to flush yet
+	logger.Logger.Info().Msg("server stopped")
 }
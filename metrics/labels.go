@@ -0,0 +1,36 @@
+package metrics
+
+import "sync"
+
+// maxMethodLabels bounds the method label values, methods are sent by clients so they can't be used as is
+const maxMethodLabels = 100
+
+var (
+	methodLabels      = make(map[string]bool)
+	methodLabelsMutex sync.RWMutex
+)
+
+// MethodLabel returns the method as label value, methods beyond the first maxMethodLabels seen are reported as "other"
+func MethodLabel(method string) string {
+	if method == "" {
+		return "unknown"
+	}
+	methodLabelsMutex.RLock()
+	known := methodLabels[method]
+	full := len(methodLabels) >= maxMethodLabels
+	methodLabelsMutex.RUnlock()
+	if known {
+		return method
+	}
+	if full || len(method) > 64 {
+		return "other"
+	}
+
+	methodLabelsMutex.Lock()
+	defer methodLabelsMutex.Unlock()
+	if len(methodLabels) >= maxMethodLabels {
+		return "other"
+	}
+	methodLabels[method] = true
+	return method
+}
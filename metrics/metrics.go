@@ -3,8 +3,17 @@ package metrics
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync/atomic"
 )
 
+// cacheEntries is the func() int counting the responses in the cache, see SetCacheEntries
+var cacheEntries atomic.Value
+
+// SetCacheEntries sets how the cache entries gauge counts the responses in the cache
+func SetCacheEntries(count func() int) {
+	cacheEntries.Store(count)
+}
+
 var (
 	CallsCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -38,4 +47,107 @@ var (
 		},
 		[]string{"chainID", "url"},
 	)
+
+	ChainIDMismatchGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rpc_chain_id_mismatch",
+			Help: "Whether the URL reports a chain ID different from the chain it is listed under (1: misconfigured)",
+		},
+		[]string{"chainID", "url"},
+	)
+
+	HeadLagBlocksGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rpc_head_lag_blocks",
+			Help: "Blocks each URL is behind the chain head",
+		},
+		[]string{"chainID", "url"},
+	)
+
+	HeadLagSecondsGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rpc_head_lag_seconds",
+			Help: "Seconds the latest block of each URL is behind the chain head's block",
+		},
+		[]string{"chainID", "url"},
+	)
+
+	RequestsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_gateway_requests_total",
+			Help: "Total number of requests to the gateway by chain and method",
+		},
+		[]string{"chainID", "method"},
+	)
+
+	CacheLookupsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_cache_lookups_total",
+			Help: "Total number of cache lookups by chain, method and result (hit, stale, miss)",
+		},
+		[]string{"chainID", "method", "result"},
+	)
+
+	CacheStoresCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_cache_stores_total",
+			Help: "Total number of responses stored in the cache by chain and method",
+		},
+		[]string{"chainID", "method"},
+	)
+
+	CacheEvictionsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_cache_evictions_total",
+			Help: "Total number of responses evicted from the cache by chain, method and reason (expired, reorg, mined, purge)",
+		},
+		[]string{"chainID", "method", "reason"},
+	)
+
+	// CacheEntriesGauge counts the cache entries when scraped, so the requests don't lock every shard of the cache
+	CacheEntriesGauge = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "rpc_cache_entries",
+			Help: "Number of responses in the cache, including the expired ones not cleaned up yet",
+		},
+		func() float64 {
+			if count, ok := cacheEntries.Load().(func() int); ok {
+				return float64(count())
+			}
+			return 0
+		},
+	)
+
+	ForwardErrorsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_forward_errors_total",
+			Help: "Total number of failed calls to each URL by reason",
+		},
+		[]string{"chainID", "url", "reason"},
+	)
+
+	CoalescedRequestsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_coalesced_requests_total",
+			Help: "Total number of requests served by an upstream call shared with identical concurrent requests",
+		},
+		[]string{"chainID"},
+	)
+
+	ReorgsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rpc_reorgs_total",
+			Help: "Total number of chain reorgs detected on the followed new heads",
+		},
+		[]string{"chainID"},
+	)
+
+	ReorgDepthHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rpc_reorg_depth_blocks",
+			Help:    "Number of blocks replaced by each reorg",
+			Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 128},
+		},
+		[]string{"chainID"},
+	)
 )
@@ -1,15 +1,34 @@
 package metrics
 
 import (
+	"context"
+	"errors"
 	"github.com/huahuayu/onerpc/flags"
 	"github.com/huahuayu/onerpc/logger"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 )
 
+var server *http.Server
+
+// StartServer serves the metrics in the background until Shutdown
 func StartServer() {
 	port := *flags.MetricsPort
 	logger.Logger.Info().Msg("starting metrics server on port " + port)
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":"+port, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server = &http.Server{Addr: ":" + port, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Logger.Error().Str("error", err.Error()).Msg("metrics server stopped")
+		}
+	}()
+}
+
+// Shutdown stops the metrics server, waiting for in-flight scrapes until ctx is done
+func Shutdown(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
 }
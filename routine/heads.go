@@ -0,0 +1,127 @@
+package routine
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/logger"
+	"github.com/huahuayu/onerpc/rpc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FollowHeads subscribes to newHeads for every chain with a newHeadsURL in its policy, so the chain head used for the lag
+// threshold is tracked in real time instead of once per health check interval, and reorgs are detected
+func FollowHeads() {
+	for chainID, policy := range flags.GetPolicies().ChainPolicies {
+		if policy.NewHeadsURL == "" {
+			continue
+		}
+		go followHeads(chainID, policy.NewHeadsURL)
+	}
+}
+
+// followHeads keeps the newHeads subscription alive, reconnecting with an exponential backoff until Stop
+func followHeads(chainID int64, url string) {
+	backoff := time.Second
+	for {
+		received, err := subscribeHeads(chainID, url)
+		rpc.ForgetHead(chainID, url)
+		if stopped() {
+			return
+		}
+		if received {
+			backoff = time.Second
+		}
+		logger.Logger.Warn().
+			Str("chainID", strconv.FormatInt(chainID, 10)).
+			Str("url", url).
+			Str("error", fmt.Sprint(err)).
+			Msgf("newHeads subscription ended, reconnecting in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func subscribeHeads(chainID int64, url string) (received bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*flags.RPCTimeout)*time.Second)
+	defer cancel()
+	client, err := ethclient.DialContext(ctx, url)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	// Never follow a node of another chain
+	id, err := client.ChainID(ctx)
+	if err != nil {
+		return false, err
+	}
+	if id.Int64() != chainID {
+		return false, fmt.Errorf("chain id mismatch: expected %d, got %d", chainID, id.Int64())
+	}
+
+	headers := make(chan newHead)
+	sub, err := client.Client().EthSubscribe(context.Background(), headers, "newHeads")
+	if err != nil {
+		return false, err
+	}
+	defer sub.Unsubscribe()
+	logger.Logger.Info().Str("chainID", strconv.FormatInt(chainID, 10)).Str("url", url).Msg("following newHeads")
+
+	parent := func(hash string) (rpc.Block, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*flags.RPCTimeout)*time.Second)
+		defer cancel()
+		var block *newHead
+		if err := client.Client().CallContext(ctx, &block, "eth_getBlockByHash", hash, false); err != nil {
+			return rpc.Block{}, err
+		}
+		if block == nil {
+			return rpc.Block{}, fmt.Errorf("block %s not found", hash)
+		}
+		return block.block(), nil
+	}
+	for {
+		select {
+		case err := <-sub.Err():
+			return received, err
+		case <-stop:
+			return received, nil
+		case header := <-headers:
+			received = true
+			rpc.ReportHead(chainID, url, int64(header.Number), int64(header.Time))
+			rpc.ReportBlock(chainID, header.block(), parent)
+		}
+	}
+}
+
+func stopped() bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// newHead is a block header as reported by the node, its hash is taken as reported since not every chain hashes its
+// headers the way ethereum does
+type newHead struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       string         `json:"hash"`
+	ParentHash string         `json:"parentHash"`
+	Time       hexutil.Uint64 `json:"timestamp"`
+}
+
+func (h newHead) block() rpc.Block {
+	return rpc.Block{Number: int64(h.Number), Hash: strings.ToLower(h.Hash), ParentHash: strings.ToLower(h.ParentHash)}
+}
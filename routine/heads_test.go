@@ -0,0 +1,26 @@
+package routine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFollowHeadsStop(t *testing.T) {
+	oldStop := stop
+	stop = make(chan struct{})
+	t.Cleanup(func() { stop = oldStop })
+
+	done := make(chan struct{})
+	go func() {
+		// Nothing listens there, so the subscription fails and followHeads backs off
+		followHeads(1, "ws://127.0.0.1:1")
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("followHeads still running after stop")
+	}
+}
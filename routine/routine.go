@@ -1,12 +1,16 @@
 package routine
 
 import (
+	"fmt"
 	"github.com/huahuayu/onerpc/chainlist"
 	"github.com/huahuayu/onerpc/flags"
 	"github.com/huahuayu/onerpc/global"
 	"github.com/huahuayu/onerpc/logger"
 	"github.com/huahuayu/onerpc/rpc"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,43 +25,97 @@ func RefreshChainInfo() {
 	// Create a ticker that update the chain info every 1 hour
 	ticker := time.NewTicker(1 * time.Hour)
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				updateChainInfo()
+				if err := updateChainInfo(); err != nil {
+					logger.Logger.Error().Str("error", err.Error()).Msg("refresh chainInfo")
+				}
+			case <-stop:
+				return
 			}
 		}
 	}()
 }
 
+var (
+	stop     = make(chan struct{})
+	stopOnce sync.Once
+)
+
+// Stop stops the chain info refreshes, the newHeads subscriptions and the health checks of the rpcs
+func Stop() {
+	stopOnce.Do(func() { close(stop) })
+	rpc.StopHealthChecks()
+}
+
+var (
+	// loaded is set once a chain list is in use, from then on a failed refresh keeps the current chain list
+	loaded bool
+	// loadedChainList is the chain list in use as loaded, before the additional rpcs are merged into it
+	loadedChainList chainlist.ChainList
+	// updateMutex serializes the chain list refreshes & config reloads
+	updateMutex sync.Mutex
+)
+
 func updateChainInfo() error {
-	var RPCMap map[int64]rpc.RPCs
-	_, _, RPCMap, err := chainlist.GetAllChainInfo()
+	chainList, err := loadChainList()
 	if err != nil {
 		return err
 	}
-	oldRPCMap := global.RPCMap
-	global.RPCMap = RPCMap
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	loadedChainList = chainList
+	loaded = true
+	applyChainList(chainList)
+	return nil
+}
 
-	fallbackMap := make(map[int64]rpc.RPCs)
-	for chainID, rpcList := range flags.FallbackRPCs {
-		rpcs := rpc.NewRPCs(chainID, rpcList)
-		fallbackMap[chainID] = rpcs
+// ReloadConfig reloads the config file and applies the new upstreams & policies, the rpcs of unchanged urls keep their
+// health state. A failed reload keeps the current config.
+func ReloadConfig() error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	policies, err := flags.Reload()
+	if err != nil {
+		logger.Logger.Error().Str("error", err.Error()).Msg("config reload failed, keeping the current config")
+		return err
 	}
-	oldFallbackMap := global.FallbackMap
-	global.FallbackMap = fallbackMap
-
-	// Stop the old rpcs refresh routines
-	for _, rpcs := range oldRPCMap {
-		if rpcs != nil {
-			rpcs.StopRefreshRpcStatus()
-		}
+	if loaded {
+		applyChainList(loadedChainList)
 	}
-	for _, rpcs := range oldFallbackMap {
-		if rpcs != nil {
-			rpcs.StopRefreshRpcStatus()
-		}
+	logger.Logger.Info().
+		Int("additionalRPCChains", len(policies.AdditionalRPCs)).
+		Int("fallbackChains", len(policies.FallbackRPCs)).
+		Int("cacheableMethods", len(policies.CacheableMethods)).
+		Bool("rateLimit", policies.EnableRateLimit).
+		Msg("config reloaded")
+	return nil
+}
+
+// applyChainList merges the additional rpcs into the chain list and swaps the rpc pools, keeping the RPC instances of
+// unchanged urls
+func applyChainList(chainList chainlist.ChainList) {
+	chainList, chainMap := chainlist.Prepare(chainList)
+	global.SetChains(chainList, chainMap)
+	urls := make(map[int64][]string)
+	for _, chain := range chainList {
+		urls[chain.ChainID] = chain.RPC
 	}
+	RPCMap, added, removed := mergeRPCMap(global.GetRPCMap(), urls)
+	applyRPCInfo(RPCMap, chainMap)
+	global.SetRPCMap(RPCMap)
+
+	fallbackMap, addedFallbacks, removedFallbacks := mergeRPCMap(global.GetFallbackMap(), flags.GetPolicies().FallbackRPCs)
+	applyRPCInfo(fallbackMap, chainMap)
+	global.SetFallbackMap(fallbackMap)
+
+	// Stop checking the rpcs no longer listed, only the new rpcs need to start, the kept ones are already scheduled
+	removed.StopRefreshRpcStatus()
+	removedFallbacks.StopRefreshRpcStatus()
+	added.RefreshRpcStatus()
+	addedFallbacks.RefreshRpcStatus()
 
 	var (
 		totalRPCs         int
@@ -65,16 +123,106 @@ func updateChainInfo() error {
 	)
 	for _, rpcs := range RPCMap {
 		totalRPCs += len(rpcs)
-		go func(rpcs rpc.RPCs) {
-			rpcs.RefreshRpcStatus()
-		}(rpcs)
 	}
 	for _, rpcs := range fallbackMap {
 		totalFallbackRPCs += len(rpcs)
-		go func(rpcs rpc.RPCs) {
-			rpcs.RefreshRpcStatus()
-		}(rpcs)
 	}
-	logger.Logger.Info().Msgf("%d chains with %d rpcs, and %d fallback rpcs refreshed", len(RPCMap), totalRPCs, totalFallbackRPCs)
+	logger.Logger.Info().
+		Int("added", len(added)+len(addedFallbacks)).
+		Int("removed", len(removed)+len(removedFallbacks)).
+		Msgf("%d chains with %d rpcs, and %d fallback rpcs refreshed", len(RPCMap), totalRPCs, totalFallbackRPCs)
+}
+
+// mergeRPCMap diffs the rpcs of each chain against the new url lists, keeping the RPC instances of unchanged urls
+func mergeRPCMap(old map[int64]rpc.RPCs, urls map[int64][]string) (merged map[int64]rpc.RPCs, added, removed rpc.RPCs) {
+	merged = make(map[int64]rpc.RPCs, len(urls))
+	for chainID, chainURLs := range urls {
+		rpcs, chainAdded, chainRemoved := old[chainID].Merge(chainID, chainURLs)
+		merged[chainID] = rpcs
+		added = append(added, chainAdded...)
+		removed = append(removed, chainRemoved...)
+	}
+	for chainID, rpcs := range old {
+		if _, ok := urls[chainID]; !ok {
+			removed = append(removed, rpcs...)
+		}
+	}
+	return merged, added, removed
+}
+
+// applyRPCInfo sets the privacy metadata of the rpcs: the tracking set by the config, the metadata of the chain registry,
+// or none for the operator's upstreams & fallbacks unknown to the registry. Other rpcs stay unspecified.
+func applyRPCInfo(rpcMap map[int64]rpc.RPCs, chainMap map[int64]*chainlist.ChainInfo) {
+	policies := flags.GetPolicies()
+	for chainID, rpcs := range rpcMap {
+		chain := chainMap[chainID]
+		for _, r := range rpcs {
+			if upstream, ok := policies.Upstreams[chainID][r.URL]; ok && upstream.Tracking != "" {
+				r.SetPrivacy(upstream.Tracking, "set by the config", false)
+				continue
+			}
+			if chain != nil && chain.RPCInfo[r.URL] != nil {
+				info := chain.RPCInfo[r.URL]
+				r.SetPrivacy(info.Tracking, info.TrackingDetails, info.IsOpenSource)
+				continue
+			}
+			if slices.Contains(policies.AdditionalRPCs[chainID], r.URL) || slices.Contains(policies.FallbackRPCs[chainID], r.URL) {
+				r.SetPrivacy(rpc.TrackingNone, "operator upstream", false)
+				continue
+			}
+			r.SetPrivacy(rpc.TrackingUnspecified, "", false)
+		}
+	}
+}
+
+// loadChainList fetches the chain list from the remote sources and saves it as the last known good snapshot unless a
+// source is missing from it, the snapshot is used instead in offline mode or if the remote sources are unreachable at
+// startup
+func loadChainList() (chainlist.ChainList, error) {
+	if *flags.Offline {
+		logger.Logger.Info().Str("path", *flags.ChainSnapshot).Msg("offline mode, loading chain snapshot")
+		return chainlist.LoadSnapshot(*flags.ChainSnapshot)
+	}
+
+	chainList, missing, err := chainlist.GetRemoteChainList()
+	if err != nil {
+		if loaded || *flags.ChainSnapshot == "" {
+			return nil, err
+		}
+		logger.Logger.Warn().Str("error", err.Error()).Str("path", *flags.ChainSnapshot).Msg("remote chain registry unreachable, loading chain snapshot")
+		chainList, snapshotErr := chainlist.LoadSnapshot(*flags.ChainSnapshot)
+		if snapshotErr != nil {
+			return nil, fmt.Errorf("%s, load chain snapshot: %s", err, snapshotErr)
+		}
+		return chainList, nil
+	}
+
+	switch {
+	case *flags.ChainSnapshot == "":
+	case len(missing) > 0:
+		// A degraded chain list would replace the complete one of the snapshot
+		logger.Logger.Warn().Strs("missing", missing).Msg("chain sources missing, chain snapshot not saved")
+	default:
+		if err := chainlist.SaveSnapshot(*flags.ChainSnapshot, chainList); err != nil {
+			logger.Logger.Error().Str("error", err.Error()).Msg("save chain snapshot")
+		}
+	}
+	return chainList, nil
+}
+
+// ExportChainList saves the merged chain list of the remote sources to path, to be used as chain snapshot, it fails if
+// a source is missing from it
+func ExportChainList(path string) error {
+	chainList, missing, err := chainlist.GetRemoteChainList()
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("chain sources failed: %s", strings.Join(missing, ", "))
+	}
+	if err := chainlist.SaveSnapshot(path, chainList); err != nil {
+		return err
+	}
+	logger.Logger.Info().Str("path", path).Msgf("%d chains exported", len(chainList))
 	return nil
 }
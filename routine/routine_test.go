@@ -0,0 +1,31 @@
+package routine
+
+import (
+	"github.com/huahuayu/onerpc/chainlist"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/rpc"
+	"testing"
+)
+
+func TestApplyRPCInfo(t *testing.T) {
+	defer flags.SetPolicies(flags.GetPolicies())
+	policies := *flags.GetPolicies()
+	policies.AdditionalRPCs = map[int64][]string{1: {"https://own.example", "https://tracked.example"}}
+	policies.FallbackRPCs = map[int64][]string{1: {"https://fallback.example"}}
+	policies.Upstreams = map[int64]map[string]flags.Upstream{1: {"https://tracked.example": {URL: "https://tracked.example", Tracking: rpc.TrackingYes}}}
+	flags.SetPolicies(&policies)
+
+	rpcs := rpc.NewRPCs(1, []string{"https://own.example", "https://tracked.example", "https://fallback.example", "https://registry.example", "https://unknown.example"})
+	chainMap := map[int64]*chainlist.ChainInfo{1: {RPCInfo: map[string]*chainlist.RPCInfo{"https://registry.example": {Tracking: rpc.TrackingLimited}}}}
+	applyRPCInfo(map[int64]rpc.RPCs{1: rpcs}, chainMap)
+
+	want := []string{rpc.TrackingNone, rpc.TrackingYes, rpc.TrackingNone, rpc.TrackingLimited, rpc.TrackingUnspecified}
+	for i, r := range rpcs {
+		if r.Tracking != want[i] {
+			t.Errorf("%s: tracking %q, want %q", r.URL, r.Tracking, want[i])
+		}
+	}
+	if got := len(rpcs.FilterPrivacy(rpc.PrivacyNone)); got != 2 {
+		t.Errorf("%d rpcs selected by the none policy, want the operator's 2", got)
+	}
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/huahuayu/onerpc/codec"
+	"github.com/huahuayu/onerpc/flags"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// compression is the response compression negotiated with an rpc, compressed responses are asked for until one can't
+// be decoded, from then on the rpc is asked for plain responses
+type compression struct {
+	disabled bool
+	encoding string // content encoding of the latest response
+}
+
+// post sends the request body to the rpc and returns the status code & the decoded response body
+func (r *RPC) post(client *http.Client, body []byte) (int, []byte, error) {
+	// The secrets are only filled in here, so they don't show up where the url is reported
+	requestURL, _ := flags.FillSecrets(r.URL, flags.RPCSecrets)
+	request, err := http.NewRequest(http.MethodPost, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, r.withURL(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	r.mutex.Lock()
+	compress := *flags.UpstreamCompression && !r.compression.disabled
+	r.mutex.Unlock()
+	if compress {
+		request.Header.Set("Accept-Encoding", codec.AcceptEncoding)
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return 0, nil, r.withURL(err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	decoded, err := codec.Decode(encoding, raw)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		r.compression.disabled = true
+		return resp.StatusCode, nil, fmt.Errorf("decode %s response err: %s, url: %s", encoding, err, r.URL)
+	}
+	r.compression.encoding = encoding
+	return resp.StatusCode, decoded, nil
+}
+
+// withURL reports the url of the rpc in the errors of the http client instead of the url with the secrets filled in
+func (r *RPC) withURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = r.URL
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"github.com/huahuayu/onerpc/flags"
+	"slices"
+	"sync"
+)
+
+// Head is the chain head, the highest block the sources of the chain agree on, see ReportHead
+type Head struct {
+	Number int64
+	Time   int64 // block timestamp in unix seconds
+}
+
+// headQuorum is the number of sources needed to reject an outlier: a report further ahead of the median report than the
+// lag threshold of the chain is an outlier, e.g. a node returning a bogus height or a block from the future. With fewer
+// sources the highest report is the chain head, so a stuck node never drags the head down to its own block.
+const headQuorum = 3
+
+// The outlier thresholds of the chains without a lag threshold
+const (
+	outlierBlocks  = 1000
+	outlierSeconds = 600
+)
+
+var (
+	heads        = make(map[int64]Head)
+	headReports  = make(map[int64]map[string]Head) // the latest block reported by each source of the chain
+	headHandlers []func(chainID int64, number int64)
+	headsMutex   sync.RWMutex
+)
+
+// OnHead registers a handler called whenever the chain head moves forward
+func OnHead(handler func(chainID int64, number int64)) {
+	headsMutex.Lock()
+	defer headsMutex.Unlock()
+	headHandlers = append(headHandlers, handler)
+}
+
+// ReportHead records the latest block seen by a source of the chain, i.e. an rpc or a newHeads subscription, and
+// updates the chain head without the outliers
+func ReportHead(chainID int64, source string, number int64, blockTime int64) {
+	policy := flags.GetChainPolicy(chainID)
+	headsMutex.Lock()
+	if headReports[chainID] == nil {
+		headReports[chainID] = make(map[string]Head)
+	}
+	headReports[chainID][source] = Head{Number: number, Time: blockTime}
+	previous := heads[chainID]
+	head := quorumHead(headReports[chainID], policy)
+	heads[chainID] = head
+	handlers := headHandlers
+	headsMutex.Unlock()
+
+	if head.Number > previous.Number {
+		for _, handler := range handlers {
+			handler(chainID, head.Number)
+		}
+	}
+}
+
+// ForgetHead drops the report of a source that's down or no longer used, so its last block doesn't count anymore
+func ForgetHead(chainID int64, source string) {
+	policy := flags.GetChainPolicy(chainID)
+	headsMutex.Lock()
+	defer headsMutex.Unlock()
+	if _, ok := headReports[chainID][source]; !ok {
+		return
+	}
+	delete(headReports[chainID], source)
+	if len(headReports[chainID]) == 0 {
+		delete(headReports, chainID)
+		delete(heads, chainID)
+		return
+	}
+	heads[chainID] = quorumHead(headReports[chainID], policy)
+}
+
+// quorumHead returns the highest block number & time of the reports that aren't outliers
+func quorumHead(reports map[string]Head, policy flags.ChainPolicy) Head {
+	numbers := make([]int64, 0, len(reports))
+	times := make([]int64, 0, len(reports))
+	for _, report := range reports {
+		numbers = append(numbers, report.Number)
+		if report.Time > 0 {
+			times = append(times, report.Time)
+		}
+	}
+	blocks, seconds := policy.LagLimits()
+	if blocks <= 0 {
+		blocks = outlierBlocks
+	}
+	if seconds <= 0 {
+		seconds = outlierSeconds
+	}
+	return Head{Number: highestInQuorum(numbers, blocks), Time: highestInQuorum(times, seconds)}
+}
+
+// highestInQuorum returns the highest value within the threshold of the median value, or the highest value if there are
+// fewer than headQuorum values
+func highestInQuorum(values []int64, threshold int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	slices.Sort(values)
+	if len(values) < headQuorum {
+		return values[len(values)-1]
+	}
+	limit := values[len(values)/2] + threshold
+	for i := len(values) - 1; ; i-- {
+		if values[i] <= limit {
+			return values[i]
+		}
+	}
+}
+
+// GetHead returns the chain head of the chain
+func GetHead(chainID int64) (Head, bool) {
+	headsMutex.RLock()
+	defer headsMutex.RUnlock()
+	head, ok := heads[chainID]
+	return head, ok
+}
+
+// lag returns how far a block is behind the chain head in blocks and seconds, negative if it's ahead of the head,
+// i.e. an outlier
+func lag(chainID int64, number int64, blockTime int64) (blocks int64, seconds int64) {
+	head, ok := GetHead(chainID)
+	if !ok {
+		return 0, 0
+	}
+	blocks = head.Number - number
+	if blockTime == 0 || head.Time == 0 {
+		return blocks, 0
+	}
+	return blocks, head.Time - blockTime
+}
@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"fmt"
+)
+
+// PrivacyPolicy is the most tracking an rpc may do to be selected, based on the tracking metadata of chainlist.org
+type PrivacyPolicy string
+
+const (
+	// PrivacyNone only selects rpcs that don't track at all
+	PrivacyNone PrivacyPolicy = "none"
+	// PrivacyLimited also selects rpcs with limited tracking
+	PrivacyLimited PrivacyPolicy = "limited"
+	// PrivacyNoTracking selects every rpc except the ones known to track
+	PrivacyNoTracking PrivacyPolicy = "no-yes"
+	// PrivacyAny selects every rpc
+	PrivacyAny PrivacyPolicy = "any"
+)
+
+// Tracking values of chainlist.org, an rpc without metadata is TrackingUnspecified
+const (
+	TrackingNone        = "none"
+	TrackingLimited     = "limited"
+	TrackingYes         = "yes"
+	TrackingUnspecified = ""
+)
+
+// ParsePrivacyPolicy parses a privacy policy from flags or request headers
+func ParsePrivacyPolicy(s string) (PrivacyPolicy, error) {
+	switch policy := PrivacyPolicy(s); policy {
+	case PrivacyNone, PrivacyLimited, PrivacyNoTracking, PrivacyAny:
+		return policy, nil
+	case "":
+		return PrivacyAny, nil
+	}
+	return "", fmt.Errorf("invalid privacy policy: %s, should be one of none, limited, no-yes, any", s)
+}
+
+// Stricter returns the stricter of the two policies
+func (p PrivacyPolicy) Stricter(other PrivacyPolicy) PrivacyPolicy {
+	if other.level() < p.level() {
+		return other
+	}
+	return p
+}
+
+// Allows reports whether an rpc with the given tracking may be selected
+func (p PrivacyPolicy) Allows(tracking string) bool {
+	return trackingLevel(tracking) <= p.level()
+}
+
+func (p PrivacyPolicy) level() int {
+	switch p {
+	case PrivacyNone:
+		return 0
+	case PrivacyLimited:
+		return 1
+	case PrivacyNoTracking:
+		return 2
+	}
+	return 3
+}
+
+func trackingLevel(tracking string) int {
+	switch tracking {
+	case TrackingNone:
+		return 0
+	case TrackingLimited:
+		return 1
+	case TrackingYes:
+		return 3
+	}
+	return 2
+}
+
+// SetPrivacy sets the tracking metadata of the rpc
+func (r *RPC) SetPrivacy(tracking string, trackingDetails string, isOpenSource bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Tracking = tracking
+	r.TrackingDetails = trackingDetails
+	r.IsOpenSource = isOpenSource
+}
+
+// FilterPrivacy returns the rpcs allowed by the privacy policy
+func (rpcs RPCs) FilterPrivacy(policy PrivacyPolicy) RPCs {
+	if policy == PrivacyAny {
+		return rpcs
+	}
+	filtered := make(RPCs, 0, len(rpcs))
+	for _, rpc := range rpcs {
+		rpc.mutex.Lock()
+		tracking := rpc.Tracking
+		rpc.mutex.Unlock()
+		if policy.Allows(tracking) {
+			filtered = append(filtered, rpc)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"github.com/huahuayu/onerpc/logger"
+	"github.com/huahuayu/onerpc/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reorgHistory is how many recent blocks are kept per chain, reorgs deeper than that are only detected partially
+const reorgHistory = 128
+
+// recentReorgs is how many reorg events are kept per chain
+const recentReorgs = 20
+
+// Block is a block header of the chain
+type Block struct {
+	Number     int64
+	Hash       string
+	ParentHash string
+}
+
+// Reorg is a chain reorganization: the blocks from Number on were replaced by another branch
+type Reorg struct {
+	ChainID int64    `json:"chainId"`
+	Number  int64    `json:"number"` // first replaced block
+	Depth   int      `json:"depth"`
+	Hashes  []string `json:"hashes"` // the replaced block hashes
+	Head    int64    `json:"head"`   // the new head
+	Time    int64    `json:"time"`   // unix seconds
+}
+
+// Numbers returns the replaced block numbers
+func (r Reorg) Numbers() []int64 {
+	numbers := make([]int64, r.Depth)
+	for i := range numbers {
+		numbers[i] = r.Number + int64(i)
+	}
+	return numbers
+}
+
+// blockHistory is the recent canonical blocks of a chain by number, locked while a head is recorded so walking back a
+// new branch on the network only holds up the reports of the same chain
+type blockHistory struct {
+	sync.Mutex
+	blocks map[int64]Block
+}
+
+var (
+	histories     = make(map[int64]*blockHistory)
+	reorgs        = make(map[int64][]Reorg)
+	reorgHandlers []func(Reorg)
+	// reorgMutex guards the maps & the handlers, not the block histories
+	reorgMutex sync.Mutex
+)
+
+// OnReorg registers a handler called for every detected reorg
+func OnReorg(handler func(Reorg)) {
+	reorgMutex.Lock()
+	defer reorgMutex.Unlock()
+	reorgHandlers = append(reorgHandlers, handler)
+}
+
+// RecentReorgs returns the latest reorgs of the chain, the most recent first
+func RecentReorgs(chainID int64) []Reorg {
+	reorgMutex.Lock()
+	defer reorgMutex.Unlock()
+	recent := make([]Reorg, 0, len(reorgs[chainID]))
+	for i := len(reorgs[chainID]) - 1; i >= 0; i-- {
+		recent = append(recent, reorgs[chainID][i])
+	}
+	return recent
+}
+
+// ReportBlock records a new head of the chain as followed on one node, a head not linked to the recorded blocks by its
+// parent hash is a reorg. The replaced blocks are found by walking the new branch back by its parent hashes with
+// parent, until it meets the recorded blocks.
+func ReportBlock(chainID int64, block Block, parent func(hash string) (Block, error)) {
+	reorgMutex.Lock()
+	history, ok := histories[chainID]
+	if !ok {
+		history = &blockHistory{blocks: make(map[int64]Block)}
+		histories[chainID] = history
+	}
+	reorgMutex.Unlock()
+
+	history.Lock()
+	reorg := history.record(chainID, block, parent)
+	history.Unlock()
+	if reorg == nil {
+		return
+	}
+
+	reorgMutex.Lock()
+	reorgs[chainID] = append(reorgs[chainID], *reorg)
+	if len(reorgs[chainID]) > recentReorgs {
+		reorgs[chainID] = reorgs[chainID][1:]
+	}
+	handlers := reorgHandlers
+	reorgMutex.Unlock()
+
+	chainLabel := strconv.FormatInt(chainID, 10)
+	metrics.ReorgsCounter.WithLabelValues(chainLabel).Inc()
+	metrics.ReorgDepthHistogram.WithLabelValues(chainLabel).Observe(float64(reorg.Depth))
+	logger.Logger.Warn().
+		Str("chainID", chainLabel).
+		Int64("number", reorg.Number).
+		Int("depth", reorg.Depth).
+		Int64("head", reorg.Head).
+		Strs("hashes", reorg.Hashes).
+		Msg("reorg")
+	for _, handler := range handlers {
+		handler(*reorg)
+	}
+}
+
+// record adds the block to the history of the chain, returning the reorg it reveals if any
+func (h *blockHistory) record(chainID int64, block Block, parent func(hash string) (Block, error)) *Reorg {
+	history := h.blocks
+	if recorded, ok := history[block.Number]; ok && recorded.Hash == block.Hash {
+		return nil
+	}
+
+	// The recorded blocks from the new head on were replaced, e.g. by a shorter branch
+	replaced := make(map[int64]string)
+	for number, recorded := range history {
+		if number >= block.Number {
+			replaced[number] = recorded.Hash
+			delete(history, number)
+		}
+	}
+	// So are the recorded blocks up to where the new branch links to them
+	for current := block; len(replaced) < reorgHistory; {
+		previous, ok := history[current.Number-1]
+		if !ok || previous.Hash == current.ParentHash {
+			break
+		}
+		replaced[previous.Number] = previous.Hash
+		delete(history, previous.Number)
+		if parent == nil {
+			break
+		}
+		next, err := parent(current.ParentHash)
+		if err != nil || next.Number != current.Number-1 {
+			logger.Logger.Warn().Str("chainID", strconv.FormatInt(chainID, 10)).Int64("number", current.Number-1).
+				Msg("reorg: failed to get the parent block, the reorg may be deeper")
+			break
+		}
+		history[next.Number] = next
+		current = next
+	}
+	history[block.Number] = block
+	for number := range history {
+		if number <= block.Number-reorgHistory {
+			delete(history, number)
+		}
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+
+	reorg := &Reorg{ChainID: chainID, Number: block.Number, Head: block.Number, Time: time.Now().Unix()}
+	for number := range replaced {
+		reorg.Number = min(reorg.Number, number)
+	}
+	last := reorg.Number
+	for number := range replaced {
+		last = max(last, number)
+	}
+	reorg.Depth = int(last-reorg.Number) + 1
+	for number := reorg.Number; number <= last; number++ {
+		if hash, ok := replaced[number]; ok {
+			reorg.Hashes = append(reorg.Hashes, hash)
+		}
+	}
+	return reorg
+}
@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// resetReorgs drops the history & reorgs of the chain and the handlers registered by the test
+func resetReorgs(t *testing.T, chainID int64) {
+	reorgMutex.Lock()
+	handlers := reorgHandlers
+	reorgMutex.Unlock()
+	t.Cleanup(func() {
+		reorgMutex.Lock()
+		defer reorgMutex.Unlock()
+		delete(histories, chainID)
+		delete(reorgs, chainID)
+		reorgHandlers = handlers
+	})
+}
+
+func TestReportBlock(t *testing.T) {
+	const chainID = 99999
+	resetReorgs(t, chainID)
+	hash := func(branch string, number int64) string { return fmt.Sprintf("0x%s%d", branch, number) }
+	block := func(branch, parentBranch string, number int64) Block {
+		return Block{Number: number, Hash: hash(branch, number), ParentHash: hash(parentBranch, number-1)}
+	}
+	var reported []Reorg
+	OnReorg(func(r Reorg) {
+		if r.ChainID == chainID {
+			reported = append(reported, r)
+		}
+	})
+
+	for number := int64(1); number <= 10; number++ {
+		ReportBlock(chainID, block("a", "a", number), nil)
+	}
+	ReportBlock(chainID, block("a", "a", 10), nil)
+	if len(reported) != 0 {
+		t.Fatalf("reorg reported on a linked chain: %+v", reported)
+	}
+
+	// The b branch forks off after block 7, its head 10 is found by walking back its parents
+	branch := map[string]Block{hash("b", 9): block("b", "b", 9), hash("b", 8): block("b", "a", 8)}
+	ReportBlock(chainID, block("b", "b", 10), func(h string) (Block, error) {
+		if b, ok := branch[h]; ok {
+			return b, nil
+		}
+		return Block{}, fmt.Errorf("unknown block %s", h)
+	})
+	if len(reported) != 1 {
+		t.Fatalf("%d reorgs reported, want 1", len(reported))
+	}
+	reorg := reported[0]
+	if reorg.Number != 8 || reorg.Depth != 3 || fmt.Sprint(reorg.Hashes) != fmt.Sprint([]string{hash("a", 8), hash("a", 9), hash("a", 10)}) {
+		t.Fatalf("reorg %+v, want blocks 8 to 10 of branch a replaced", reorg)
+	}
+	if recent := RecentReorgs(chainID); len(recent) != 1 || recent[0].Number != 8 {
+		t.Fatalf("recent reorgs %+v", recent)
+	}
+
+	// A shorter branch replaces the blocks above its head
+	ReportBlock(chainID, block("c", "b", 10), nil)
+	if len(reported) != 2 || reported[1].Number != 10 || reported[1].Depth != 1 {
+		t.Fatalf("reorg to a sibling head %+v", reported)
+	}
+}
+
+func TestReportBlockSlowParent(t *testing.T) {
+	const slowChainID, chainID = 99998, 99997
+	resetReorgs(t, slowChainID)
+	resetReorgs(t, chainID)
+	ReportBlock(slowChainID, Block{Number: 1, Hash: "0xa1"}, nil)
+
+	// Walking back the new branch of one chain doesn't hold up the other chains
+	walking, release, slowDone := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		ReportBlock(slowChainID, Block{Number: 2, Hash: "0xb2", ParentHash: "0xb1"}, func(hash string) (Block, error) {
+			close(walking)
+			<-release
+			return Block{}, fmt.Errorf("unknown block %s", hash)
+		})
+		close(slowDone)
+	}()
+	<-walking
+	done := make(chan struct{})
+	go func() {
+		ReportBlock(chainID, Block{Number: 1, Hash: "0xa1"}, nil)
+		RecentReorgs(chainID)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("blocked by the parent lookup of another chain")
+	}
+	close(release)
+	<-slowDone
+	if recent := RecentReorgs(slowChainID); len(recent) != 1 || recent[0].Number != 1 {
+		t.Fatalf("recent reorgs %+v", recent)
+	}
+}
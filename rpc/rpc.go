@@ -2,13 +2,12 @@ package rpc
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/huahuayu/onerpc/flags"
 	"github.com/huahuayu/onerpc/logger"
 	"github.com/huahuayu/onerpc/metrics"
-	"io"
+	"math"
 	"math/big"
 	"math/rand"
 	"net/http"
@@ -20,15 +19,23 @@ import (
 )
 
 type RPC struct {
-	ChainID int64
-	URL     string
-	Height  int64
-	Status  Status
-	mutex   sync.Mutex
-	client  *http.Client
-	ctx     context.Context
-	cancel  context.CancelFunc
-	ticker  *time.Ticker
+	ChainID         int64
+	URL             string
+	Height          int64
+	BlockTime       int64 // timestamp of the latest block in unix seconds
+	LagBlocks       int64 // blocks behind the chain head at the last health check, negative if ahead of it (an outlier)
+	LagSeconds      int64 // seconds behind the chain head's block time at the last health check, negative if ahead of it
+	Status          Status
+	ReportedChainID int64  // chain ID reported by eth_chainId (or net_version if eth_chainId is unsupported)
+	NetworkID       int64  // network ID reported by net_version
+	Tracking        string // tracking of the rpc according to chainlist.org: none, limited, yes or empty if unspecified
+	TrackingDetails string
+	IsOpenSource    bool
+	chainIDCheckAt  time.Time
+	mutex           sync.Mutex
+	client          *http.Client
+	stats           stats
+	compression     compression
 }
 
 type RPCs []*RPC
@@ -39,14 +46,19 @@ const (
 	Unknown Status = "Unknown"
 	OK      Status = "OK"
 	Down    Status = "Down"
+	// Misconfigured means the node answers for a different chain than the one it is listed under
+	Misconfigured Status = "Misconfigured"
 )
 
-var httpClientCache = make(map[string]*http.Client)
+var (
+	httpClientCache      = make(map[string]*http.Client)
+	httpClientCacheMutex sync.Mutex
+)
 
 func NewRPC(chainID int64, url string) *RPC {
-	ctx, cancel := context.WithCancel(context.Background())
-	ticker := time.NewTicker(time.Duration(*flags.RPCHealthCheckInterval) * time.Minute)
 	// Use http client cache to avoid creating too many http clients
+	httpClientCacheMutex.Lock()
+	defer httpClientCacheMutex.Unlock()
 	var httpClient *http.Client
 	if _, ok := httpClientCache[url]; !ok {
 		httpClient = &http.Client{
@@ -68,63 +80,195 @@ func NewRPC(chainID int64, url string) *RPC {
 		Status:  Unknown,
 		mutex:   sync.Mutex{},
 		client:  httpClient,
-		ctx:     ctx,
-		cancel:  cancel,
-		ticker:  ticker,
 	}
 }
 
-func (r *RPC) updateHeight() error {
-	payload := []byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)
-	resp, err := r.client.Post(r.URL, "application/json", bytes.NewBuffer(payload))
-	if err != nil || resp == nil || resp.StatusCode != http.StatusOK {
-		r.mutex.Lock()
-		r.Status = Down
-		r.mutex.Unlock()
+func (r *RPC) updateHeight() (err error) {
+	// A failing rpc's last block no longer counts for the chain head
+	defer func() {
+		if err != nil {
+			ForgetHead(r.ChainID, r.URL)
+		}
+	}()
+	if err := r.verifyChainID(); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	result, err := r.call("eth_getBlockByNumber", "latest", false)
 	if err != nil {
+		r.mutex.Lock()
+		r.Status = Down
+		r.mutex.Unlock()
 		return err
 	}
 
-	type JSONRPCResponse struct {
-		JSONRPC string `json:"jsonrpc"`
-		Id      int    `json:"id"`
-		Result  any    `json:"result"`
+	var block struct {
+		Number    string `json:"number"`
+		Timestamp string `json:"timestamp"`
 	}
-
-	var response JSONRPCResponse
-	err = json.Unmarshal(body, &response)
+	if err := json.Unmarshal(result, &block); err != nil || block.Number == "" || block.Number == "0x" || block.Number == "0x0" {
+		return fmt.Errorf("invalid block: %s, url: %s", string(result), r.URL)
+	}
+	blockNumber, err := parseQuantity(block.Number)
 	if err != nil {
-		return fmt.Errorf("unmarshal response err: %s, url: %s", err, r.URL)
+		return fmt.Errorf("%s, url: %s", err, r.URL)
 	}
+	blockTime, _ := parseQuantity(block.Timestamp)
+
+	// The lag is measured against the chain head at check time, so it doesn't grow while waiting for the next check
+	ReportHead(r.ChainID, r.URL, blockNumber, blockTime)
+	lagBlocks, lagSeconds := lag(r.ChainID, blockNumber, blockTime)
 
-	number, ok := response.Result.(string)
-	if !ok || number == "" || number == "0x" || number == "0x0" {
-		return fmt.Errorf("invalid block number: %s, url: %s", number, r.URL)
-	}
-	blockNumber, ok := new(big.Int).SetString(number[2:], 16) // Remove the "0x" prefix and convert from hex to int
-	if !ok {
-		return nil
-	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.Status = OK
-	r.Height = blockNumber.Int64()
+	r.Height = blockNumber
+	r.BlockTime = blockTime
+	r.LagBlocks = lagBlocks
+	r.LagSeconds = lagSeconds
 	logger.Logger.Debug().
 		Str("chainID", strconv.FormatInt(r.ChainID, 10)).
 		Str("url", r.URL).
 		Int64("height", r.Height).
+		Int64("lagBlocks", r.LagBlocks).
+		Int64("lagSeconds", r.LagSeconds).
 		Msg("updateHeight")
 	// Set the gauge to the latest block height
 	metrics.LatestBlockHeightGauge.WithLabelValues(fmt.Sprint(r.ChainID), r.URL).Set(float64(r.Height))
+	metrics.HeadLagBlocksGauge.WithLabelValues(fmt.Sprint(r.ChainID), r.URL).Set(float64(r.LagBlocks))
+	metrics.HeadLagSecondsGauge.WithLabelValues(fmt.Sprint(r.ChainID), r.URL).Set(float64(r.LagSeconds))
 
 	return nil
 }
 
+// isStale reports whether the rpc is further behind the chain head than the chain policy allows, or ahead of the
+// chain head, i.e. an outlier the other rpcs don't agree with
+func (r *RPC) isStale(policy flags.ChainPolicy) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.LagBlocks < 0 || r.LagSeconds < 0 {
+		return true
+	}
+	maxLagBlocks, maxLagSeconds := policy.LagLimits()
+	if maxLagBlocks > 0 && r.LagBlocks > maxLagBlocks {
+		return true
+	}
+	if maxLagSeconds > 0 && r.LagSeconds > maxLagSeconds {
+		return true
+	}
+	return false
+}
+
+// verifyChainID checks that the node serves the chain it is listed under, the check is repeated every chainIDCheckInterval
+// to catch URLs that get repointed. A node reporting a different chain ID is quarantined as Misconfigured.
+func (r *RPC) verifyChainID() error {
+	r.mutex.Lock()
+	due := r.chainIDCheckAt.IsZero() || time.Since(r.chainIDCheckAt) >= time.Duration(*flags.ChainIDCheckInterval)*time.Minute
+	quarantined := r.Status == Misconfigured
+	lastReportedChainID := r.ReportedChainID
+	r.mutex.Unlock()
+	if !due {
+		if quarantined {
+			return fmt.Errorf("chain id mismatch: expected %d, got %d, url: %s", r.ChainID, lastReportedChainID, r.URL)
+		}
+		return nil
+	}
+
+	// net_version is only used as a fallback for nodes that don't support eth_chainId (pre EIP-695),
+	// because the network ID differs from the chain ID on some chains
+	var networkID int64
+	if result, err := r.call("net_version"); err == nil {
+		var version string
+		if err := json.Unmarshal(result, &version); err == nil {
+			networkID, _ = strconv.ParseInt(version, 10, 64)
+		}
+	}
+
+	var reportedChainID int64
+	result, err := r.call("eth_chainId")
+	if err == nil {
+		var chainID string
+		if err := json.Unmarshal(result, &chainID); err == nil {
+			reportedChainID, err = parseQuantity(chainID)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid chain id: %s, url: %s", string(result), r.URL)
+		}
+	} else if networkID != 0 {
+		reportedChainID = networkID
+	} else {
+		r.mutex.Lock()
+		r.Status = Down
+		r.mutex.Unlock()
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.chainIDCheckAt = time.Now()
+	r.ReportedChainID = reportedChainID
+	r.NetworkID = networkID
+	if reportedChainID != r.ChainID {
+		if r.Status != Misconfigured {
+			logger.Logger.Warn().
+				Str("chainID", strconv.FormatInt(r.ChainID, 10)).
+				Str("url", r.URL).
+				Int64("reportedChainID", reportedChainID).
+				Msg("chain id mismatch, rpc quarantined")
+		}
+		r.Status = Misconfigured
+		metrics.ChainIDMismatchGauge.WithLabelValues(fmt.Sprint(r.ChainID), r.URL).Set(1)
+		return fmt.Errorf("chain id mismatch: expected %d, got %d, url: %s", r.ChainID, reportedChainID, r.URL)
+	}
+	metrics.ChainIDMismatchGauge.WithLabelValues(fmt.Sprint(r.ChainID), r.URL).Set(0)
+	return nil
+}
+
+// call sends a single JSON RPC request to the node and returns the raw result
+func (r *RPC) call(method string, params ...any) (json.RawMessage, error) {
+	if params == nil {
+		params = []any{}
+	}
+	payload, err := json.Marshal(map[string]any{"jsonrpc": "2.0", "method": method, "params": params, "id": 1})
+	if err != nil {
+		return nil, err
+	}
+	statusCode, body, err := r.post(r.client, payload)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status code: %d, url: %s", statusCode, r.URL)
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unmarshal response err: %s, url: %s", err, r.URL)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("%s error: %d %s, url: %s", method, response.Error.Code, response.Error.Message, r.URL)
+	}
+	return response.Result, nil
+}
+
+// parseQuantity parses a hex encoded quantity like "0x1a"
+func parseQuantity(s string) (int64, error) {
+	if len(s) < 3 || s[:2] != "0x" {
+		return 0, fmt.Errorf("invalid quantity: %s", s)
+	}
+	n, ok := new(big.Int).SetString(s[2:], 16)
+	if !ok || !n.IsInt64() {
+		return 0, fmt.Errorf("invalid quantity: %s", s)
+	}
+	return n.Int64(), nil
+}
+
 func (r *RPC) forward(requestBody []byte, httpProxy ...string) ([]byte, error) {
 	var client = r.client
 
@@ -143,24 +287,18 @@ func (r *RPC) forward(requestBody []byte, httpProxy ...string) ([]byte, error) {
 	// Start the timer
 	startTime := time.Now()
 
-	resp, err := client.Post(r.URL, "application/json", bytes.NewBuffer(requestBody))
+	statusCode, body, err := r.post(client, requestBody)
 
 	// Stop the timer
 	duration := time.Since(startTime).Seconds()
 
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	// Check if the response is an error
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("response status code: %d, url: %s, body: %s", resp.StatusCode, r.URL, string(body))
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status code: %d, url: %s, body: %s", statusCode, r.URL, string(body))
 	}
 
 	// Check if body contains rate limit error
@@ -193,15 +331,53 @@ func NewRPCs(chainID int64, urls []string) RPCs {
 	return rpcs
 }
 
-// GetRandomRPC returns a random RPC from the list of RPCs, which the status is OK and the height is the highest as possible
-func (rpcs RPCs) GetRandomRPC(num int, exclude RPCs) RPCs {
-	// Filter RPCs that might work
-	mightWorkRPCs := make(RPCs, 0)
+// Merge builds the rpcs of the chain for the given urls, reusing the existing RPC instances with their status, height and
+// statistics for urls that are still listed. It returns the merged rpcs, the newly created ones and the ones no longer listed.
+func (rpcs RPCs) Merge(chainID int64, urls []string) (merged, added, removed RPCs) {
+	existing := make(map[string]*RPC, len(rpcs))
+	for _, rpc := range rpcs {
+		existing[rpc.URL] = rpc
+	}
+	merged = make(RPCs, 0, len(urls))
+	seen := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		if rpc, ok := existing[url]; ok {
+			merged = append(merged, rpc)
+			delete(existing, url)
+			continue
+		}
+		rpc := NewRPC(chainID, url)
+		merged = append(merged, rpc)
+		added = append(added, rpc)
+	}
 	for _, rpc := range rpcs {
-		if rpc.Status == OK {
-			mightWorkRPCs = append(mightWorkRPCs, rpc)
+		if _, ok := existing[rpc.URL]; ok {
+			removed = append(removed, rpc)
 		}
 	}
+	return merged, added, removed
+}
+
+// Available returns the RPCs that can be selected: the status is OK and they are within the lag threshold of the chain policy
+func (rpcs RPCs) Available() RPCs {
+	available := make(RPCs, 0)
+	for _, rpc := range rpcs {
+		if rpc.Status == OK && !rpc.isStale(flags.GetChainPolicy(rpc.ChainID)) {
+			available = append(available, rpc)
+		}
+	}
+	return available
+}
+
+// GetRandomRPC returns a random RPC from the list of RPCs, which the status is OK and the height is the highest as possible,
+// RPCs lagging behind the chain head more than the chain policy allows are never selected
+func (rpcs RPCs) GetRandomRPC(num int, exclude RPCs) RPCs {
+	// Filter RPCs that might work
+	mightWorkRPCs := rpcs.Available()
 
 	// Exclude the RPCs that are in the exclude list
 	for _, rpc := range exclude {
@@ -217,14 +393,34 @@ func (rpcs RPCs) GetRandomRPC(num int, exclude RPCs) RPCs {
 		return nil
 	}
 
-	// Sort the RPCs by height in descending order
-	sort.Slice(mightWorkRPCs, func(i, j int) bool {
-		return mightWorkRPCs[i].Height > mightWorkRPCs[j].Height
-	})
+	// Group the RPCs by tier, the lower tiers are used first
+	tiers := make(map[int]RPCs)
+	for _, rpc := range mightWorkRPCs {
+		tier := flags.GetUpstream(rpc.ChainID, rpc.URL).Tier
+		tiers[tier] = append(tiers[tier], rpc)
+	}
+	tierNumbers := make([]int, 0, len(tiers))
+	for tier := range tiers {
+		tierNumbers = append(tierNumbers, tier)
+	}
+	sort.Ints(tierNumbers)
+
+	selectedRPCs := make(RPCs, 0, num)
+	for _, tier := range tierNumbers {
+		selectedRPCs = append(selectedRPCs, tiers[tier].selectByHeight(num-len(selectedRPCs))...)
+		if len(selectedRPCs) >= num {
+			break
+		}
+	}
+	return selectedRPCs
+}
 
+// selectByHeight selects up to num RPCs, starting from the ones with the highest height, RPCs with the same height are
+// selected randomly by their weight
+func (rpcs RPCs) selectByHeight(num int) RPCs {
 	// Group the RPCs with the same height together
 	groupedRPCs := make(map[int64]RPCs)
-	for _, rpc := range mightWorkRPCs {
+	for _, rpc := range rpcs {
 		groupedRPCs[rpc.Height] = append(groupedRPCs[rpc.Height], rpc)
 	}
 
@@ -240,47 +436,47 @@ func (rpcs RPCs) GetRandomRPC(num int, exclude RPCs) RPCs {
 	// Start from the group with the highest height, select RPCs randomly until the number of RPCs is satisfied
 	selectedRPCs := make(RPCs, 0, num)
 	for _, height := range heights {
-		sameHeightRPCs := groupedRPCs[height]
-		perm := rand.Perm(len(sameHeightRPCs))
-		for _, idx := range perm {
+		for _, rpc := range groupedRPCs[height].weightedShuffle() {
 			if len(selectedRPCs) < num {
-				selectedRPCs = append(selectedRPCs, sameHeightRPCs[idx])
+				selectedRPCs = append(selectedRPCs, rpc)
 			} else {
 				return selectedRPCs
 			}
 		}
 	}
-
 	return selectedRPCs
 }
 
-func (rpcs RPCs) RefreshRpcStatus() {
+// weightedShuffle returns the RPCs in a random order where an RPC with twice the weight is twice as likely to come first
+func (rpcs RPCs) weightedShuffle() RPCs {
+	keys := make(map[*RPC]float64, len(rpcs))
 	for _, rpc := range rpcs {
-		go func(rpc *RPC) {
-			rpc.updateHeight()
-			for {
-				select {
-				case <-rpc.ticker.C:
-					rpc.updateHeight()
-				case <-rpc.ctx.Done():
-					rpc.ticker.Stop()
-					return
-				}
-			}
-		}(rpc)
+		weight := float64(flags.GetUpstream(rpc.ChainID, rpc.URL).Weight)
+		keys[rpc] = math.Pow(rand.Float64(), 1/weight)
 	}
+	shuffled := append(RPCs{}, rpcs...)
+	sort.Slice(shuffled, func(i, j int) bool {
+		return keys[shuffled[i]] > keys[shuffled[j]]
+	})
+	return shuffled
+}
+
+// RefreshRpcStatus schedules the rpcs for periodic health checks
+func (rpcs RPCs) RefreshRpcStatus() {
+	healthChecker.add(rpcs)
 }
 
+// StopRefreshRpcStatus stops the health checks of the rpcs
 func (rpcs RPCs) StopRefreshRpcStatus() {
-	for _, rpc := range rpcs {
-		if rpc.cancel != nil {
-			rpc.cancel()
-		}
-	}
+	healthChecker.remove(rpcs)
 }
 
 // SendRequest sends JSON RPC request by selecting a random RPC from the list of good status RPCs
 func (rpcs RPCs) SendRequest(body []byte, numberOfRPCs int, exclude RPCs, httpProxy ...string) (response []byte, origins RPCs, err error) {
+	if len(rpcs) > 0 {
+		MarkActive(rpcs[0].ChainID)
+	}
+
 	// Select a random RPC from the list of RPCs
 	randRPCs := rpcs.GetRandomRPC(numberOfRPCs, exclude)
 	if len(randRPCs) == 0 {
@@ -292,9 +488,12 @@ func (rpcs RPCs) SendRequest(body []byte, numberOfRPCs int, exclude RPCs, httpPr
 	respChan := make(chan []byte, len(randRPCs))
 	for _, rpc := range randRPCs {
 		go func(rpc *RPC) {
+			start := time.Now()
 			resp, err := rpc.forward(body, httpProxy...)
+			rpc.recordCall(time.Since(start), err)
 			if err != nil {
 				metrics.CallErrorCounter.WithLabelValues(fmt.Sprint(rpc.ChainID), rpc.URL, err.Error()).Inc()
+				metrics.ForwardErrorsCounter.WithLabelValues(fmt.Sprint(rpc.ChainID), rpc.URL, errorReason(err)).Inc()
 				errChan <- err
 				return
 			}
@@ -1,7 +1,15 @@
 package rpc
 
 import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/codec"
+	"github.com/huahuayu/onerpc/flags"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRPC_UpdateHeight(t *testing.T) {
@@ -15,3 +23,403 @@ func TestRPC_UpdateHeight(t *testing.T) {
 	}
 	t.Log(rpc.Height)
 }
+
+// newTestNode starts a JSON RPC server answering eth_chainId, net_version and eth_getBlockByNumber
+func newTestNode(t *testing.T, chainID, networkID, blockNumber string, blockTime ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Method string `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timestamp := "0x65cdc7d7"
+		if len(blockTime) > 0 {
+			timestamp = blockTime[0]
+		}
+		results := map[string]any{"eth_chainId": chainID, "net_version": networkID, "eth_getBlockByNumber": map[string]string{"number": blockNumber, "timestamp": timestamp}}
+		w.Header().Set("Content-Type", "application/json")
+		if result, ok := results[request.Method]; ok && result != "" {
+			json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": 1, "result": result})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": 1, "error": map[string]any{"code": -32601, "message": "method not found"}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRPC_VerifyChainID(t *testing.T) {
+	tests := []struct {
+		name       string
+		chainID    string
+		networkID  string
+		wantStatus Status
+	}{
+		{"matching chain id", "0x1", "1", OK},
+		{"testnet listed as mainnet", "0xaa36a7", "11155111", Misconfigured},
+		{"eth_chainId unsupported, net_version matches", "", "1", OK},
+		{"eth_chainId unsupported, net_version mismatches", "", "5", Misconfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t, tt.chainID, tt.networkID, "0x10")
+			rpc := NewRPC(1, node.URL)
+			err := rpc.updateHeight()
+			if rpc.Status != tt.wantStatus {
+				t.Fatalf("status = %s, want %s (err: %v)", rpc.Status, tt.wantStatus, err)
+			}
+			if tt.wantStatus == Misconfigured {
+				if err == nil {
+					t.Fatal("expected chain id mismatch error")
+				}
+				// The quarantine sticks until the next chain id check
+				if err := rpc.updateHeight(); err == nil || rpc.Status != Misconfigured {
+					t.Fatalf("quarantine lifted before next chain id check, status = %s", rpc.Status)
+				}
+				if len(RPCs{rpc}.GetRandomRPC(1, nil)) != 0 {
+					t.Fatal("misconfigured rpc selected")
+				}
+				return
+			}
+			if rpc.Height != 16 {
+				t.Fatalf("height = %d, want 16", rpc.Height)
+			}
+		})
+	}
+}
+
+func TestRPCs_GetRandomRPCExcludesStale(t *testing.T) {
+	const chainID = 99991 // a chain id no other test reports heads for
+	nodes := []struct {
+		blockNumber string
+		blockTime   string
+	}{
+		{"0x3e8", "0x65cdc7d7"}, // head
+		{"0x3e7", "0x65cdc7cb"}, // one block, 12 seconds behind
+		{"0x64", "0x65cd0000"},  // far behind
+	}
+	rpcs := make(RPCs, 0)
+	for _, node := range nodes {
+		server := newTestNode(t, "0x18697", "99991", node.blockNumber, node.blockTime)
+		rpcs = append(rpcs, NewRPC(chainID, server.URL))
+	}
+	for _, rpc := range rpcs {
+		if err := rpc.updateHeight(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rpcs[2].LagBlocks != 900 {
+		t.Fatalf("lagBlocks = %d, want 900", rpcs[2].LagBlocks)
+	}
+
+	selected := rpcs.GetRandomRPC(3, nil)
+	if len(selected) != 2 {
+		t.Fatalf("selected %d rpcs, want 2", len(selected))
+	}
+	for _, rpc := range selected {
+		if rpc == rpcs[2] {
+			t.Fatal("stale rpc selected")
+		}
+	}
+}
+
+func TestRPCs_RogueHead(t *testing.T) {
+	const chainID = 99995
+	nodes := []struct {
+		blockNumber string
+		blockTime   string
+	}{
+		{"0x3e8", "0x65cdc7d7"},
+		{"0x3e8", "0x65cdc7d7"},
+		{"0x3e7", "0x65cdc7cb"},
+		{"0x3b9aca00", "0x7fffffff"}, // a bogus height from the future
+	}
+	rpcs := make(RPCs, 0)
+	for _, node := range nodes {
+		server := newTestNode(t, "0x1869b", "99995", node.blockNumber, node.blockTime)
+		rpcs = append(rpcs, NewRPC(chainID, server.URL))
+	}
+	for _, rpc := range rpcs {
+		if err := rpc.updateHeight(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if head, _ := GetHead(chainID); head.Number != 0x3e8 || head.Time != 0x65cdc7d7 {
+		t.Fatalf("head = %+v, raised by the rogue node", head)
+	}
+	selected := rpcs.GetRandomRPC(4, nil)
+	if len(selected) != 3 {
+		t.Fatalf("selected %d rpcs, want the 3 honest ones", len(selected))
+	}
+	for _, rpc := range selected {
+		if rpc == rpcs[3] {
+			t.Fatal("rogue rpc selected")
+		}
+	}
+
+	// The head follows the honest rpcs once the rogue one is gone
+	ForgetHead(chainID, rpcs[3].URL)
+	ForgetHead(chainID, rpcs[0].URL)
+	if head, _ := GetHead(chainID); head.Number != 0x3e8 {
+		t.Fatalf("head = %+v after forgetting the rogue rpc", head)
+	}
+}
+
+func TestRPCs_StuckHead(t *testing.T) {
+	const chainID = 99994
+	defer flags.SetPolicies(flags.GetPolicies())
+	policies := *flags.GetPolicies()
+	policies.ChainPolicies = maps.Clone(policies.ChainPolicies)
+	maxLagBlocks := int64(10)
+	policies.ChainPolicies[chainID] = &flags.ChainPolicy{ChainID: chainID, MaxLagBlocks: &maxLagBlocks}
+	flags.SetPolicies(&policies)
+
+	healthy := NewRPC(chainID, newTestNode(t, "0x1869a", "99994", "0x3e8", "0x65cdc7d7").URL)
+	stuck := NewRPC(chainID, newTestNode(t, "0x1869a", "99994", "0x64", "0x65cd0000").URL)
+	for _, rpc := range (RPCs{stuck, healthy}) {
+		if err := rpc.updateHeight(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		ForgetHead(chainID, healthy.URL)
+		ForgetHead(chainID, stuck.URL)
+	})
+
+	// With two rpcs the highest block is the head, the stuck rpc lags behind it from its next check on
+	if head, _ := GetHead(chainID); head.Number != 0x3e8 {
+		t.Fatalf("head = %+v, want the healthy rpc's block", head)
+	}
+	if err := stuck.updateHeight(); err != nil {
+		t.Fatal(err)
+	}
+	if available := (RPCs{stuck, healthy}).Available(); len(available) != 1 || available[0] != healthy {
+		t.Fatalf("available %v, want only the healthy rpc", available)
+	}
+}
+
+func TestScheduler_RemoveDuringCheck(t *testing.T) {
+	const chainID = 99993
+	rpc := NewRPC(chainID, newTestNode(t, "0x18699", "99993", "0x3e8").URL)
+	s := newScheduler()
+
+	// The rpc is removed while its check runs, the check's head report doesn't outlive it
+	entry := &checkEntry{rpc: rpc, index: -1, removed: true}
+	done := make(chan struct{})
+	go func() {
+		s.work()
+		close(done)
+	}()
+	s.jobs <- entry
+	close(s.jobs)
+	<-done
+	if head, ok := GetHead(chainID); ok {
+		t.Fatalf("head %+v reported by a removed rpc", head)
+	}
+}
+
+func TestCheckInterval(t *testing.T) {
+	const chainID = 99992
+	t.Cleanup(func() { chainActivity.Delete(int64(chainID)) })
+	rpc := NewRPC(chainID, "http://127.0.0.1:0")
+	base := time.Duration(*flags.RPCHealthCheckInterval) * time.Minute
+	idle := time.Duration(*flags.RPCHealthCheckIdleInterval) * time.Minute
+	maxBackoff := time.Duration(*flags.RPCHealthCheckMaxBackoff) * time.Minute
+
+	if got := checkInterval(rpc, 0); got != idle {
+		t.Fatalf("idle chain interval = %s, want %s", got, idle)
+	}
+	MarkActive(chainID)
+	if got := checkInterval(rpc, 0); got != base {
+		t.Fatalf("active chain interval = %s, want %s", got, base)
+	}
+	if got := checkInterval(rpc, 3); got != 4*base {
+		t.Fatalf("backoff after 3 failures = %s, want %s", got, 4*base)
+	}
+	if got := checkInterval(rpc, 100); got != maxBackoff {
+		t.Fatalf("backoff after 100 failures = %s, want %s", got, maxBackoff)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	node := newTestNode(t, "0x1", "1", "0x10")
+	rpc := NewRPC(1, node.URL)
+	RPCs{rpc}.RefreshRpcStatus()
+	defer RPCs{rpc}.StopRefreshRpcStatus()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rpc.mutex.Lock()
+		status := rpc.Status
+		rpc.mutex.Unlock()
+		if status == OK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rpc not checked, status = %s", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRPCs_Merge(t *testing.T) {
+	old := NewRPCs(1, []string{"https://a.example", "https://b.example"})
+	old[0].Status = OK
+	old[0].Height = 100
+
+	merged, added, removed := old.Merge(1, []string{"https://a.example", "https://c.example", "https://c.example"})
+	if len(merged) != 2 || len(added) != 1 || len(removed) != 1 {
+		t.Fatalf("merged %d, added %d, removed %d, want 2, 1, 1", len(merged), len(added), len(removed))
+	}
+	if merged[0] != old[0] || merged[0].Status != OK || merged[0].Height != 100 {
+		t.Fatal("existing rpc not kept")
+	}
+	if added[0].URL != "https://c.example" || added[0].Status != Unknown {
+		t.Fatalf("unexpected added rpc %s %s", added[0].URL, added[0].Status)
+	}
+	if removed[0] != old[1] {
+		t.Fatal("unexpected removed rpc")
+	}
+}
+
+func TestRPCs_FilterPrivacy(t *testing.T) {
+	rpcs := NewRPCs(1, []string{"https://none.example", "https://limited.example", "https://unspecified.example", "https://yes.example"})
+	rpcs[0].SetPrivacy(TrackingNone, "", true)
+	rpcs[1].SetPrivacy(TrackingLimited, "", false)
+	rpcs[3].SetPrivacy(TrackingYes, "collects IP addresses", false)
+
+	tests := []struct {
+		policy PrivacyPolicy
+		want   int
+	}{
+		{PrivacyNone, 1},
+		{PrivacyLimited, 2},
+		{PrivacyNoTracking, 3},
+		{PrivacyAny, 4},
+	}
+	for _, tt := range tests {
+		if got := len(rpcs.FilterPrivacy(tt.policy)); got != tt.want {
+			t.Errorf("%s: got %d rpcs, want %d", tt.policy, got, tt.want)
+		}
+	}
+
+	// Clients can only choose a stricter policy than the operator
+	if got := PrivacyNoTracking.Stricter(PrivacyAny); got != PrivacyNoTracking {
+		t.Errorf("stricter = %s, want %s", got, PrivacyNoTracking)
+	}
+	if got := PrivacyNoTracking.Stricter(PrivacyNone); got != PrivacyNone {
+		t.Errorf("stricter = %s, want %s", got, PrivacyNone)
+	}
+	if _, err := ParsePrivacyPolicy("private"); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
+
+func TestRPCs_GetRandomRPCTiers(t *testing.T) {
+	const chainID = 99994
+	defer flags.SetPolicies(flags.GetPolicies())
+	policies := *flags.GetPolicies()
+	policies.Upstreams = map[int64]map[string]flags.Upstream{chainID: {
+		"https://primary.example.com": {Weight: 1, Tier: 0},
+		"https://heavy.example.com":   {Weight: 9, Tier: 0},
+		"https://backup.example.com":  {Weight: 1, Tier: 1},
+	}}
+	flags.SetPolicies(&policies)
+
+	rpcs := make(RPCs, 0)
+	for _, url := range []string{"https://backup.example.com", "https://primary.example.com", "https://heavy.example.com"} {
+		rpc := NewRPC(chainID, url)
+		rpc.Status = OK
+		rpcs = append(rpcs, rpc)
+	}
+
+	heavyFirst := 0
+	for i := 0; i < 1000; i++ {
+		selected := rpcs.GetRandomRPC(1, nil)
+		if len(selected) != 1 || selected[0].URL == "https://backup.example.com" {
+			t.Fatal("the backup tier should only be used once the lower tier is exhausted")
+		}
+		if selected[0].URL == "https://heavy.example.com" {
+			heavyFirst++
+		}
+	}
+	// The heavy rpc should come first about 90% of the time
+	if heavyFirst < 800 {
+		t.Fatalf("heavy rpc selected first %d/1000 times", heavyFirst)
+	}
+
+	if selected := rpcs.GetRandomRPC(3, nil); len(selected) != 3 || selected[2].URL != "https://backup.example.com" {
+		t.Fatal("the backup tier should fill up the selection")
+	}
+}
+
+func TestRPC_SecretPlaceholder(t *testing.T) {
+	flags.RPCSecrets["TEST_API_KEY"] = "secret"
+	t.Cleanup(func() { delete(flags.RPCSecrets, "TEST_API_KEY") })
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	defer server.Close()
+
+	rpc := NewRPC(1, server.URL+"/v3/${TEST_API_KEY}")
+	if _, err := rpc.call("eth_blockNumber"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v3/secret" {
+		t.Fatalf("path = %s, the secret wasn't filled in", path)
+	}
+
+	// The errors report the url with the placeholder
+	server.Close()
+	_, err := rpc.call("eth_blockNumber")
+	if err == nil || strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), "${TEST_API_KEY}") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestRPC_UpstreamCompression(t *testing.T) {
+	var acceptEncoding string
+	broken := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		body := []byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`)
+		if broken {
+			w.Header().Set("Content-Encoding", codec.Gzip)
+			w.Write(body)
+			return
+		}
+		if encoding := codec.Negotiate(acceptEncoding); encoding != codec.Identity {
+			body, _ = codec.Encode(encoding, body)
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+	rpc := NewRPC(1, server.URL)
+
+	result, err := rpc.call("eth_blockNumber")
+	if err != nil || string(result) != `"0x10"` {
+		t.Fatalf("result = %s, err: %v", result, err)
+	}
+	if rpc.Stats().Encoding != codec.Zstd {
+		t.Fatalf("encoding = %q, want zstd", rpc.Stats().Encoding)
+	}
+
+	// An undecodable response stops asking the rpc for compressed responses
+	broken = true
+	if _, err := rpc.call("eth_blockNumber"); err == nil {
+		t.Fatal("expected a decode error")
+	}
+	broken = false
+	if _, err := rpc.call("eth_blockNumber"); err != nil {
+		t.Fatal(err)
+	}
+	if acceptEncoding == codec.AcceptEncoding {
+		t.Fatal("compressed responses still asked for")
+	}
+}
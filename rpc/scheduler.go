@@ -0,0 +1,268 @@
+package rpc
+
+import (
+	"container/heap"
+	"github.com/huahuayu/onerpc/flags"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeWindow is how long a chain counts as active after its last request
+const activeWindow = 5 * time.Minute
+
+// healthChecker runs the health checks of all rpcs, see scheduler
+var healthChecker = newScheduler()
+
+// chainActivity holds the unix time of the last request per chain, map[int64]*atomic.Int64
+var chainActivity sync.Map
+
+// scheduler runs health checks from a bounded worker pool instead of one goroutine & ticker per rpc.
+// Every rpc has its own next check time with jitter: healthy rpcs of idle chains are checked less often,
+// failing rpcs back off exponentially and rpcs of chains with traffic are checked at the chain's health check interval.
+type scheduler struct {
+	mutex   sync.Mutex
+	queue   checkQueue
+	entries map[*RPC]*checkEntry
+	wake    chan struct{}
+	jobs    chan *checkEntry
+	once    sync.Once
+	done    chan struct{}
+	stopped sync.Once
+}
+
+type checkEntry struct {
+	rpc      *RPC
+	next     time.Time
+	failures int
+	index    int // index in the queue, -1 while the check is running
+	removed  bool
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		entries: make(map[*RPC]*checkEntry),
+		wake:    make(chan struct{}, 1),
+		jobs:    make(chan *checkEntry),
+		done:    make(chan struct{}),
+	}
+}
+
+// start launches the dispatcher and the workers on first use
+func (s *scheduler) start() {
+	s.once.Do(func() {
+		workers := *flags.HealthCheckConcurrency
+		if workers <= 0 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			go s.work()
+		}
+		go s.dispatch()
+	})
+}
+
+// stop ends the dispatcher & the workers, the checks already running finish
+func (s *scheduler) stop() {
+	s.stopped.Do(func() { close(s.done) })
+}
+
+// add schedules the first check of the rpcs within a second, the bounded pool spreads them out from there
+func (s *scheduler) add(rpcs RPCs) {
+	s.start()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rpc := range rpcs {
+		if _, ok := s.entries[rpc]; ok {
+			continue
+		}
+		entry := &checkEntry{rpc: rpc, next: time.Now().Add(time.Duration(rand.Int63n(int64(time.Second))))}
+		s.entries[rpc] = entry
+		heap.Push(&s.queue, entry)
+	}
+	s.signal()
+}
+
+// remove stops checking the rpcs, a check that is already running finishes but isn't rescheduled
+func (s *scheduler) remove(rpcs RPCs) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rpc := range rpcs {
+		entry, ok := s.entries[rpc]
+		if !ok {
+			continue
+		}
+		entry.removed = true
+		delete(s.entries, rpc)
+		ForgetHead(rpc.ChainID, rpc.URL)
+		if entry.index >= 0 {
+			heap.Remove(&s.queue, entry.index)
+		}
+	}
+}
+
+// expedite brings the next check of the chain's rpcs forward to the chain's health check interval
+func (s *scheduler) expedite(chainID int64) {
+	interval := time.Duration(flags.GetChainPolicy(chainID).HealthCheckInterval) * time.Second
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, entry := range s.entries {
+		if entry.rpc.ChainID != chainID || entry.index < 0 {
+			continue
+		}
+		if next := time.Now().Add(jitter(interval)); next.Before(entry.next) {
+			entry.next = next
+			heap.Fix(&s.queue, entry.index)
+		}
+	}
+	s.signal()
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands due checks to the workers, blocking while all workers are busy
+func (s *scheduler) dispatch() {
+	defer close(s.jobs)
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.wake:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		entry := s.queue[0]
+		wait := time.Until(entry.next)
+		if wait <= 0 {
+			heap.Pop(&s.queue)
+			s.mutex.Unlock()
+			select {
+			case s.jobs <- entry:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		s.mutex.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *scheduler) work() {
+	for entry := range s.jobs {
+		err := entry.rpc.updateHeight()
+
+		s.mutex.Lock()
+		if entry.removed {
+			// The check reported the head after remove forgot it
+			ForgetHead(entry.rpc.ChainID, entry.rpc.URL)
+			s.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			entry.failures++
+		} else {
+			entry.failures = 0
+		}
+		entry.next = time.Now().Add(jitter(checkInterval(entry.rpc, entry.failures)))
+		heap.Push(&s.queue, entry)
+		s.signal()
+		s.mutex.Unlock()
+	}
+}
+
+// checkInterval returns the delay until the next health check of the rpc
+func checkInterval(r *RPC, failures int) time.Duration {
+	interval := time.Duration(flags.GetChainPolicy(r.ChainID).HealthCheckInterval) * time.Second
+	if failures > 0 {
+		maxBackoff := time.Duration(*flags.RPCHealthCheckMaxBackoff) * time.Minute
+		for i := 1; i < failures && interval < maxBackoff; i++ {
+			interval *= 2
+		}
+		if interval > maxBackoff {
+			interval = maxBackoff
+		}
+		return interval
+	}
+	if !isActive(r.ChainID) {
+		if idleInterval := time.Duration(*flags.RPCHealthCheckIdleInterval) * time.Minute; idleInterval > interval {
+			return idleInterval
+		}
+	}
+	return interval
+}
+
+// jitter spreads d by ±20% so checks scheduled together drift apart
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+}
+
+// StopHealthChecks stops the health checks of all rpcs, e.g. on shutdown
+func StopHealthChecks() {
+	healthChecker.stop()
+}
+
+// MarkActive records a request for the chain, the chain's rpcs are checked sooner if it was idle
+func MarkActive(chainID int64) {
+	now := time.Now().Unix()
+	value, _ := chainActivity.LoadOrStore(chainID, new(atomic.Int64))
+	last := value.(*atomic.Int64).Swap(now)
+	if now-last > int64(activeWindow.Seconds()) {
+		go healthChecker.expedite(chainID)
+	}
+}
+
+func isActive(chainID int64) bool {
+	value, ok := chainActivity.Load(chainID)
+	if !ok {
+		return false
+	}
+	return time.Now().Unix()-value.(*atomic.Int64).Load() <= int64(activeWindow.Seconds())
+}
+
+// checkQueue is a min-heap of check entries ordered by next check time
+type checkQueue []*checkEntry
+
+func (q checkQueue) Len() int           { return len(q) }
+func (q checkQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q checkQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *checkQueue) Push(x any) {
+	entry := x.(*checkEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *checkQueue) Pop() any {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*q = old[:n-1]
+	return entry
+}
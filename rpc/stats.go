@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyWeight is the weight of the latest call in the latency moving average
+const latencyWeight = 0.1
+
+// stats are the request statistics of an rpc, health checks are not counted
+type stats struct {
+	mutex    sync.Mutex
+	requests uint64
+	errors   uint64
+	latency  time.Duration // exponentially weighted moving average of successful calls
+}
+
+// Stats is a snapshot of the state & request statistics of an rpc
+type Stats struct {
+	URL             string  `json:"url"`
+	Status          Status  `json:"status"`
+	Height          int64   `json:"height"`
+	LagBlocks       int64   `json:"lagBlocks"`
+	LagSeconds      int64   `json:"lagSeconds"`
+	LatencyMs       float64 `json:"latencyMs"`
+	Requests        uint64  `json:"requests"`
+	Errors          uint64  `json:"errors"`
+	ErrorRate       float64 `json:"errorRate"`
+	Tracking        string  `json:"tracking"`
+	TrackingDetails string  `json:"trackingDetails,omitempty"`
+	IsOpenSource    bool    `json:"isOpenSource"`
+	Encoding        string  `json:"encoding,omitempty"` // content encoding of the latest response
+}
+
+// recordCall adds the outcome of a forwarded request to the statistics
+func (r *RPC) recordCall(duration time.Duration, err error) {
+	r.stats.mutex.Lock()
+	defer r.stats.mutex.Unlock()
+	r.stats.requests++
+	if err != nil {
+		r.stats.errors++
+		return
+	}
+	if r.stats.latency == 0 {
+		r.stats.latency = duration
+		return
+	}
+	r.stats.latency = time.Duration(latencyWeight*float64(duration) + (1-latencyWeight)*float64(r.stats.latency))
+}
+
+// Stats returns a snapshot of the state & request statistics of the rpc
+func (r *RPC) Stats() Stats {
+	r.mutex.Lock()
+	s := Stats{
+		URL:             r.URL,
+		Status:          r.Status,
+		Height:          r.Height,
+		LagBlocks:       r.LagBlocks,
+		LagSeconds:      r.LagSeconds,
+		Tracking:        r.Tracking,
+		TrackingDetails: r.TrackingDetails,
+		IsOpenSource:    r.IsOpenSource,
+		Encoding:        r.compression.encoding,
+	}
+	r.mutex.Unlock()
+
+	r.stats.mutex.Lock()
+	defer r.stats.mutex.Unlock()
+	s.LatencyMs = float64(r.stats.latency.Microseconds()) / 1000
+	s.Requests = r.stats.requests
+	s.Errors = r.stats.errors
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	}
+	return s
+}
+
+// errorReason classifies a forward error for the error breakdown, the error messages themselves are unbounded
+func errorReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "connection"
+	}
+	message := err.Error()
+	switch {
+	case strings.HasPrefix(message, "response status code"):
+		return "http_status"
+	case strings.HasPrefix(message, "rate limit"):
+		return "rate_limit"
+	case strings.HasPrefix(message, "unmarshal response"), strings.HasPrefix(message, "decode "):
+		return "invalid_response"
+	default:
+		return "other"
+	}
+}
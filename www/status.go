@@ -0,0 +1,143 @@
+package www
+
+import (
+	"encoding/json"
+	"github.com/huahuayu/onerpc/global"
+	"github.com/huahuayu/onerpc/logger"
+	"github.com/huahuayu/onerpc/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// status is the dashboard data, counters are totals since startup, the dashboard derives the rates between polls
+type status struct {
+	Time   int64         `json:"time"` // unix milliseconds
+	Chains []chainStatus `json:"chains"`
+}
+
+type chainStatus struct {
+	ChainID     int64              `json:"chainId"`
+	Name        string             `json:"name"`
+	Head        int64              `json:"head"`
+	Healthy     int                `json:"healthy"`
+	Total       int                `json:"total"`
+	Upstreams   []upstreamStatus   `json:"upstreams"`
+	Requests    float64            `json:"requests"`
+	Methods     map[string]float64 `json:"methods"`
+	CacheHits   float64            `json:"cacheHits"`
+	CacheMisses float64            `json:"cacheMisses"`
+	Errors      map[string]float64 `json:"errors"` // by reason
+}
+
+type upstreamStatus struct {
+	rpc.Stats
+	Fallback bool `json:"fallback"`
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := collectStatus()
+	if err != nil {
+		logger.Logger.Error().Str("error", err.Error()).Msg("collect dashboard status")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(s)
+}
+
+func collectStatus() (*status, error) {
+	chains := make(map[int64]*chainStatus)
+	chainOf := func(chainID int64) *chainStatus {
+		c, ok := chains[chainID]
+		if !ok {
+			c = &chainStatus{
+				ChainID:   chainID,
+				Upstreams: make([]upstreamStatus, 0),
+				Methods:   make(map[string]float64),
+				Errors:    make(map[string]float64),
+			}
+			if chain, ok := global.GetChain(chainID); ok {
+				c.Name = chain.Name
+			}
+			if head, ok := rpc.GetHead(chainID); ok {
+				c.Head = head.Number
+			}
+			chains[chainID] = c
+		}
+		return c
+	}
+
+	for chainID, rpcs := range global.GetRPCMap() {
+		c := chainOf(chainID)
+		for _, r := range rpcs {
+			stats := r.Stats()
+			c.Total++
+			if stats.Status == rpc.OK {
+				c.Healthy++
+			}
+			c.Upstreams = append(c.Upstreams, upstreamStatus{Stats: stats})
+		}
+	}
+	for chainID, rpcs := range global.GetFallbackMap() {
+		c := chainOf(chainID)
+		for _, r := range rpcs {
+			c.Upstreams = append(c.Upstreams, upstreamStatus{Stats: r.Stats(), Fallback: true})
+		}
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := labelMap(m)
+			chainID, err := strconv.ParseInt(labels["chainID"], 10, 64)
+			if err != nil {
+				continue
+			}
+			value := m.GetCounter().GetValue()
+			switch family.GetName() {
+			case "rpc_gateway_requests_total":
+				c := chainOf(chainID)
+				c.Requests += value
+				c.Methods[labels["method"]] += value
+			case "rpc_cache_lookups_total":
+				c := chainOf(chainID)
+				if labels["result"] == "hit" || labels["result"] == "stale" {
+					c.CacheHits += value
+				} else {
+					c.CacheMisses += value
+				}
+			case "rpc_forward_errors_total":
+				chainOf(chainID).Errors[labels["reason"]] += value
+			}
+		}
+	}
+
+	s := &status{Time: time.Now().UnixMilli(), Chains: make([]chainStatus, 0, len(chains))}
+	for _, c := range chains {
+		s.Chains = append(s.Chains, *c)
+	}
+	// The busiest chains first
+	sort.Slice(s.Chains, func(i, j int) bool {
+		if s.Chains[i].Requests != s.Chains[j].Requests {
+			return s.Chains[i].Requests > s.Chains[j].Requests
+		}
+		return s.Chains[i].ChainID < s.Chains[j].ChainID
+	})
+	return s, nil
+}
+
+func labelMap(m *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, label := range m.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
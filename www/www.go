@@ -0,0 +1,56 @@
+package www
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"github.com/huahuayu/onerpc/flags"
+	"github.com/huahuayu/onerpc/logger"
+	"net/http"
+)
+
+//go:embed index.html dashboard.html
+var content embed.FS
+
+var server *http.Server
+
+// StartServer serves the status dashboard in the background until Shutdown, its data is read from the in-process state
+// so prometheus isn't required
+func StartServer() {
+	port := *flags.DashboardPort
+	logger.Logger.Info().Msg("starting dashboard server on port " + port)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveFile("dashboard.html"))
+	mux.HandleFunc("/about", serveFile("index.html"))
+	mux.HandleFunc("/api/status", statusHandler)
+	server = &http.Server{Addr: ":" + port, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Logger.Error().Str("error", err.Error()).Msg("dashboard server stopped")
+		}
+	}()
+}
+
+// Shutdown stops the dashboard server, waiting for in-flight requests until ctx is done
+func Shutdown(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+func serveFile(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/about" {
+			http.NotFound(w, r)
+			return
+		}
+		page, err := content.ReadFile(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}
+}